@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Area is an area of the Home Assistant area registry
+type Area struct {
+	ID      string   `json:"area_id"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+	FloorID string   `json:"floor_id"`
+	Icon    string   `json:"icon"`
+	Picture string   `json:"picture"`
+}
+
+// AreaUpdate has the area fields to change, nil fields are left as is and
+// empty strings clear the field
+type AreaUpdate struct {
+	Name *string
+	// Aliases replaces the aliases, nil leaves them as is and an empty
+	// slice removes them
+	Aliases []string
+	FloorID *string
+	Icon    *string
+	Picture *string
+}
+
+// ListAreas returns all areas from the area registry
+func (a *Registry) ListAreas(ctx context.Context) ([]Area, error) {
+	result, err := a.hass.sendCommand(ctx, map[string]interface{}{"type": "config/area_registry/list"})
+	if err != nil {
+		return nil, err
+	}
+	var areas []Area
+	if err := result.decodeResult(&areas); err != nil {
+		return nil, fmt.Errorf("failed to decode area registry: %v", err)
+	}
+	if a.cached {
+		cached := make(map[string]Area, len(areas))
+		for _, area := range areas {
+			cached[area.ID] = area
+		}
+		a.m.Lock()
+		a.areas = cached
+		a.m.Unlock()
+	}
+	return areas, nil
+}
+
+// CreateArea creates an area, the id is given by Home Assistant. Empty
+// fields are left out.
+func (a *Registry) CreateArea(ctx context.Context, area Area) (Area, error) {
+	message := map[string]interface{}{
+		"type": "config/area_registry/create",
+		"name": area.Name}
+	if area.Aliases != nil {
+		message["aliases"] = area.Aliases
+	}
+	optional := map[string]string{"floor_id": area.FloorID, "icon": area.Icon, "picture": area.Picture}
+	for key, value := range optional {
+		if value != "" {
+			message[key] = value
+		}
+	}
+	return a.storeArea(ctx, message)
+}
+
+// UpdateArea changes the fields of the area set in update
+func (a *Registry) UpdateArea(ctx context.Context, areaID string, update AreaUpdate) (Area, error) {
+	message := map[string]interface{}{
+		"type":    "config/area_registry/update",
+		"area_id": areaID}
+	if update.Name != nil {
+		message["name"] = *update.Name
+	}
+	if update.Aliases != nil {
+		message["aliases"] = update.Aliases
+	}
+	setOptional(message, "floor_id", update.FloorID)
+	setOptional(message, "icon", update.Icon)
+	setOptional(message, "picture", update.Picture)
+	return a.storeArea(ctx, message)
+}
+
+// storeArea sends the create or update command and caches the result
+func (a *Registry) storeArea(ctx context.Context, message map[string]interface{}) (Area, error) {
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return Area{}, err
+	}
+	var area Area
+	if err := result.decodeResult(&area); err != nil {
+		return Area{}, fmt.Errorf("failed to decode area: %v", err)
+	}
+	if a.cached {
+		a.m.Lock()
+		a.areas[area.ID] = area
+		a.m.Unlock()
+	}
+	return area, nil
+}
+
+// DeleteArea deletes the area, its devices and entities are left without area
+func (a *Registry) DeleteArea(ctx context.Context, areaID string) error {
+	_, err := a.hass.sendCommand(ctx, map[string]interface{}{
+		"type":    "config/area_registry/delete",
+		"area_id": areaID})
+	if err != nil {
+		return err
+	}
+	a.m.Lock()
+	delete(a.areas, areaID)
+	a.m.Unlock()
+	return nil
+}
+
+// Areas returns the cached areas sorted by name, requires WithRegistryCache
+func (a *Registry) Areas() []Area {
+	a.m.RLock()
+	areas := make([]Area, 0, len(a.areas))
+	for _, area := range a.areas {
+		areas = append(areas, area)
+	}
+	a.m.RUnlock()
+	sort.Slice(areas, func(i, j int) bool { return areas[i].Name < areas[j].Name })
+	return areas
+}
+
+// GetArea returns the cached area with given id, requires WithRegistryCache
+func (a *Registry) GetArea(areaID string) (Area, bool) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	area, ok := a.areas[areaID]
+	return area, ok
+}
+
+// FindArea returns the cached area with given name or alias, ignoring case,
+// requires WithRegistryCache
+func (a *Registry) FindArea(name string) (Area, bool) {
+	for _, area := range a.Areas() {
+		if strings.EqualFold(area.Name, name) {
+			return area, true
+		}
+		for _, alias := range area.Aliases {
+			if strings.EqualFold(alias, name) {
+				return area, true
+			}
+		}
+	}
+	return Area{}, false
+}
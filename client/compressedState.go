@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// compressedEvent is the event of the subscribe_entities command. It holds
+// added (a), changed (c) and removed (r) entities.
+type compressedEvent struct {
+	Added   map[string]compressedState `json:"a"`
+	Changed map[string]compressedDiff  `json:"c"`
+	Removed []string                   `json:"r"`
+}
+
+// compressedState is a state using the short keys of subscribe_entities
+type compressedState struct {
+	State        interface{}            `json:"s"`
+	Attributes   map[string]interface{} `json:"a"`
+	Context      json.RawMessage        `json:"c"`
+	LastChanged  float64                `json:"lc"`
+	LastUpdated  float64                `json:"lu"`
+	LastReported float64                `json:"lr"`
+}
+
+// compressedDiff holds the changed (+) and removed (-) parts of a state
+type compressedDiff struct {
+	Additions compressedState `json:"+"`
+	// The tag "-," is needed since "-" makes encoding/json skip the field
+	Removals struct {
+		Attributes []string `json:"a"`
+	} `json:"-,"`
+}
+
+// compressedTime converts the fractional unix time used by subscribe_entities,
+// zero is a missing time and gives zero time
+func compressedTime(value float64, location *time.Location) time.Time {
+	if value == 0 {
+		return time.Time{}
+	}
+	seconds, fraction := math.Modf(value)
+	t := time.Unix(int64(seconds), int64(math.Round(fraction*1e6))*1e3)
+	if location != nil {
+		t = t.In(location)
+	}
+	return t
+}
+
+// compressedContext decodes the context that is either just the id or the
+// full context object
+func compressedContext(data json.RawMessage) (HassContext, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return HassContext{}, nil
+	}
+	if data[0] == '"' {
+		var id string
+		err := json.Unmarshal(data, &id)
+		return HassContext{ID: id}, err
+	}
+	var context ContextData
+	err := json.Unmarshal(data, &context)
+	return context.hassContext(), err
+}
+
+// newState makes a full entity state from an added compressed state
+func (a compressedState) newState(location *time.Location) (HassEntityState, error) {
+	context, err := compressedContext(a.Context)
+	if err != nil {
+		return HassEntityState{}, fmt.Errorf("context: %v", err)
+	}
+	state := HassEntityState{
+		State:       fmt.Sprint(a.State),
+		Attributes:  a.Attributes,
+		Context:     context,
+		LastChanged: compressedTime(a.LastChanged, location),
+		LastUpdated: compressedTime(a.LastChanged, location)}
+
+	if a.State == nil {
+		state.State = ""
+	}
+	if state.Attributes == nil {
+		state.Attributes = map[string]interface{}{}
+	}
+	// last_updated and last_reported are left out when same as last_changed
+	if a.LastUpdated != 0 {
+		state.LastUpdated = compressedTime(a.LastUpdated, location)
+	}
+	// History instead leaves out last_changed when same as last_updated
+	if a.LastChanged == 0 {
+		state.LastChanged = state.LastUpdated
+	}
+	state.LastReported = state.LastUpdated
+	if a.LastReported != 0 {
+		state.LastReported = compressedTime(a.LastReported, location)
+	}
+	return state, nil
+}
+
+// apply returns a new state with the diff applied to the old state
+func (a compressedDiff) apply(old HassEntityState, location *time.Location) (HassEntityState, error) {
+	new := old
+	new.Attributes = make(map[string]interface{}, len(old.Attributes))
+	for key, value := range old.Attributes {
+		new.Attributes[key] = value
+	}
+
+	add := a.Additions
+	if add.State != nil {
+		new.State = fmt.Sprint(add.State)
+	}
+	for key, value := range add.Attributes {
+		new.Attributes[key] = value
+	}
+	for _, key := range a.Removals.Attributes {
+		delete(new.Attributes, key)
+	}
+	if len(add.Context) > 0 {
+		context, err := compressedContext(add.Context)
+		if err != nil {
+			return old, fmt.Errorf("context: %v", err)
+		}
+		new.Context = context
+	}
+	if add.LastChanged != 0 {
+		new.LastChanged = compressedTime(add.LastChanged, location)
+		new.LastUpdated = new.LastChanged
+	} else if add.LastUpdated != 0 {
+		new.LastUpdated = compressedTime(add.LastUpdated, location)
+	}
+	new.LastReported = new.LastUpdated
+	if add.LastReported != 0 {
+		new.LastReported = compressedTime(add.LastReported, location)
+	}
+	return new, nil
+}
+
+// handleCompressedEvent applies an event from subscribe_entities to the
+// entity list and notifies about the changed entities
+func (a *homeAssistantPlatform) handleCompressedEvent(message Result) {
+	var event compressedEvent
+	if err := message.decodeEvent(&event); err != nil {
+		log.Errorf("Failed to decode subscribe_entities event: %v", err)
+		return
+	}
+	location := a.location()
+
+	for entityID, added := range event.Added {
+		new, err := added.newState(location)
+		if err != nil {
+			log.Errorf("Failed to decode state of %s: %v", entityID, err)
+			continue
+		}
+		old := HassEntityState{}
+		if entity, ok := a.list.GetEntity(entityID); ok {
+			old = entity.New
+		}
+		newHassEntity := NewHassEntity(entityID, entityID, old, new)
+		a.list.SetEntity(newHassEntity)
+		a.virtualEntities.changed(entityID, new)
+		a.HassChannel <- *a.joinRegistry(newHassEntity)
+	}
+
+	for entityID, changed := range event.Changed {
+		entity, ok := a.list.GetEntity(entityID)
+		if !ok {
+			log.Warnf("Got changes for unknown entity %s", entityID)
+			continue
+		}
+		new, err := changed.apply(entity.New, location)
+		if err != nil {
+			log.Errorf("Failed to apply changes to %s: %v", entityID, err)
+			continue
+		}
+		newHassEntity := NewHassEntity(entityID, entityID, entity.New, new)
+		a.list.SetEntity(newHassEntity)
+		a.virtualEntities.changed(entityID, new)
+		a.HassChannel <- *a.joinRegistry(newHassEntity)
+	}
+
+	for _, entityID := range event.Removed {
+		a.removeEntity(entityID)
+	}
+
+	// The first event holds all current states
+	if !a.entitiesSynced {
+		// Entities removed while disconnected are missing after a resubscribe
+		for _, entityID := range a.list.entityIDs() {
+			if _, ok := event.Added[entityID]; !ok {
+				a.removeEntity(entityID)
+			}
+		}
+		a.entitiesSynced = true
+		a.setReady()
+	}
+}
+
+// removeEntity removes the entity from the entity list and notifies about it
+// with an empty new state
+func (a *homeAssistantPlatform) removeEntity(entityID string) {
+	entity, ok := a.list.GetEntity(entityID)
+	if !ok {
+		return
+	}
+	a.list.RemoveEntity(entityID)
+	a.virtualEntities.changed(entityID, HassEntityState{})
+	a.HassChannel <- *a.joinRegistry(NewHassEntity(entityID, entityID, entity.New, HassEntityState{}))
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"sync/atomic"
+)
+
+// CompressionStats compares the size of the messages with the bytes sent
+// and received on the network
+type CompressionStats struct {
+	// RawBytesRead is the size of the received messages
+	RawBytesRead int64
+	// RawBytesWritten is the size of the sent messages
+	RawBytesWritten int64
+	// WireBytesRead is the bytes received on the network
+	WireBytesRead int64
+	// WireBytesWritten is the bytes sent on the network
+	WireBytesWritten int64
+}
+
+// Ratio returns the received bytes on the network per byte of received
+// messages, lower is better. Returns 1 if nothing is received.
+func (a CompressionStats) Ratio() float64 {
+	if a.RawBytesRead == 0 {
+		return 1
+	}
+	return float64(a.WireBytesRead) / float64(a.RawBytesRead)
+}
+
+// WithCompression negotiates permessage-deflate compression of the
+// websocket, reduces the traffic on slow or metered links
+func WithCompression() Option {
+	return func(a *homeAssistantPlatform) {
+		a.wsOptions.EnableCompression = true
+	}
+}
+
+// CompressionStats returns the traffic of the websocket connections since
+// the client was created, connections of WithTransport are not counted
+func (a *homeAssistantPlatform) CompressionStats() CompressionStats {
+	stats := a.wsOptions.Stats
+	return CompressionStats{
+		RawBytesRead:     atomic.LoadInt64(&stats.MessageBytesRead),
+		RawBytesWritten:  atomic.LoadInt64(&stats.MessageBytesWritten),
+		WireBytesRead:    atomic.LoadInt64(&stats.WireBytesRead),
+		WireBytesWritten: atomic.LoadInt64(&stats.WireBytesWritten)}
+}
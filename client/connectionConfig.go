@@ -0,0 +1,72 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ConnectionConfig customizes how the client connects to Home Assistant. It
+// is applied to both the websocket and the REST API calls, with
+// WithTransport only to the REST API calls.
+type ConnectionConfig struct {
+	// TLSConfig is used for secure connections, set RootCAs to trust a
+	// private CA or Certificates to use client certificates
+	TLSConfig *tls.Config
+	// Proxy returns the proxy to use for a request, if nil the proxy is
+	// taken from the environment like http.ProxyFromEnvironment
+	Proxy func(*http.Request) (*url.URL, error)
+	// Header is added to the websocket handshake and to every REST call
+	Header http.Header
+	// HandshakeTimeout limits the websocket and TLS handshakes, zero uses
+	// the defaults
+	HandshakeTimeout time.Duration
+}
+
+// WithConnectionConfig applies the connection config to the websocket and
+// REST connections
+func WithConnectionConfig(config ConnectionConfig) Option {
+	return func(a *homeAssistantPlatform) {
+		a.wsOptions.TLSConfig = config.TLSConfig
+		a.wsOptions.Proxy = config.Proxy
+		a.wsOptions.Header = config.Header
+		a.wsOptions.HandshakeTimeout = config.HandshakeTimeout
+		a.header = config.Header
+		a.httpClient = config.httpClient()
+	}
+}
+
+// httpClient makes a http client using the config
+func (a ConnectionConfig) httpClient() *http.Client {
+	proxy := a.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	handshakeTimeout := a.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = 10 * time.Second
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			TLSClientConfig:     a.TLSConfig,
+			TLSHandshakeTimeout: handshakeTimeout,
+			DialContext: (&net.Dialer{
+				Timeout:   handshakeTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:    10,
+			IdleConnTimeout: 90 * time.Second,
+		}}
+}
+
+// setHeaders adds the custom headers from the connection config
+func setHeaders(req *http.Request, header http.Header) {
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+}
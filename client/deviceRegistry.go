@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Device is a device of the Home Assistant device registry
+type Device struct {
+	ID string `json:"id"`
+	// Name is the name given by the integration
+	Name string `json:"name"`
+	// NameByUser is the name given by the user, if any
+	NameByUser   string `json:"name_by_user"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	SWVersion    string `json:"sw_version"`
+	HWVersion    string `json:"hw_version"`
+	AreaID       string `json:"area_id"`
+	// Identifiers are pairs of domain and id used by the integrations
+	Identifiers [][]string `json:"identifiers"`
+	// Connections are pairs of type and id, like mac addresses
+	Connections [][]string `json:"connections"`
+	// ViaDeviceID is the device that connects this device, like a hub
+	ViaDeviceID string `json:"via_device_id"`
+	// DisabledBy is "user", "integration" or "config_entry" if disabled
+	DisabledBy    string   `json:"disabled_by"`
+	EntryType     string   `json:"entry_type"`
+	ConfigEntries []string `json:"config_entries"`
+}
+
+// DisplayName returns the name given by the user, or by the integration
+func (a Device) DisplayName() string {
+	if a.NameByUser != "" {
+		return a.NameByUser
+	}
+	return a.Name
+}
+
+// DeviceUpdate has the device fields to change, nil fields are left as is
+// and empty strings clear the field
+type DeviceUpdate struct {
+	AreaID     *string
+	NameByUser *string
+	// DisabledBy can only be set to "user" or cleared
+	DisabledBy *string
+}
+
+// setOptional adds a field to an update command, nil is left out and empty
+// string clears the field
+func setOptional(message map[string]interface{}, key string, value *string) {
+	if value == nil {
+		return
+	}
+	if *value == "" {
+		message[key] = nil
+		return
+	}
+	message[key] = *value
+}
+
+// ListDevices returns all devices from the device registry
+func (a *Registry) ListDevices(ctx context.Context) ([]Device, error) {
+	result, err := a.hass.sendCommand(ctx, map[string]interface{}{"type": "config/device_registry/list"})
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	if err := result.decodeResult(&devices); err != nil {
+		return nil, fmt.Errorf("failed to decode device registry: %v", err)
+	}
+	if a.cached {
+		cached := make(map[string]Device, len(devices))
+		for _, device := range devices {
+			cached[device.ID] = device
+		}
+		a.m.Lock()
+		a.devices = cached
+		a.m.Unlock()
+	}
+	return devices, nil
+}
+
+// UpdateDevice changes the area, name or disabled state of a device
+func (a *Registry) UpdateDevice(ctx context.Context, deviceID string, update DeviceUpdate) (Device, error) {
+	message := map[string]interface{}{
+		"type":      "config/device_registry/update",
+		"device_id": deviceID}
+	setOptional(message, "area_id", update.AreaID)
+	setOptional(message, "name_by_user", update.NameByUser)
+	setOptional(message, "disabled_by", update.DisabledBy)
+
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return Device{}, err
+	}
+	var device Device
+	if err := result.decodeResult(&device); err != nil {
+		return Device{}, fmt.Errorf("failed to decode device: %v", err)
+	}
+	if a.cached {
+		a.m.Lock()
+		a.devices[device.ID] = device
+		a.m.Unlock()
+	}
+	return device, nil
+}
+
+// Devices returns the cached devices sorted by name, requires
+// WithRegistryCache
+func (a *Registry) Devices() []Device {
+	a.m.RLock()
+	devices := make([]Device, 0, len(a.devices))
+	for _, device := range a.devices {
+		devices = append(devices, device)
+	}
+	a.m.RUnlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DisplayName() < devices[j].DisplayName() })
+	return devices
+}
+
+// GetDevice returns the cached device with given id, requires
+// WithRegistryCache
+func (a *Registry) GetDevice(deviceID string) (Device, bool) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	device, ok := a.devices[deviceID]
+	return device, ok
+}
+
+// EntityDevice returns the cached device the entity belongs to, requires
+// WithRegistryCache
+func (a *Registry) EntityDevice(entity *HassEntity) (Device, bool) {
+	if entity == nil {
+		return Device{}, false
+	}
+	entry, ok := a.GetEntry(entity.ID)
+	if !ok || entry.DeviceID == "" {
+		return Device{}, false
+	}
+	return a.GetDevice(entry.DeviceID)
+}
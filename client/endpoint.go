@@ -0,0 +1,89 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// endpoint holds the websocket and REST API urls of Home Assistant
+type endpoint struct {
+	websocket *url.URL
+	api       *url.URL
+}
+
+// newEndpoint derives the websocket and REST API urls from the base url of
+// Home Assistant, like http://192.168.1.5:8123 or https://example.com/hass
+// when behind a reverse proxy using a sub path.
+func newEndpoint(baseURL string) (endpoint, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return endpoint{}, err
+	}
+	if base.Host == "" {
+		return endpoint{}, fmt.Errorf("missing host in url %q", baseURL)
+	}
+	prefix := strings.TrimSuffix(base.Path, "/")
+	return newProxiedEndpoint(base, prefix+"/api/websocket", prefix+"/api")
+}
+
+// newProxiedEndpoint makes an endpoint with explicit paths, used when the
+// websocket is not found under the api path like for the Supervisor proxy
+func newProxiedEndpoint(base *url.URL, websocketPath, apiPath string) (endpoint, error) {
+	var wsScheme, apiScheme string
+	switch base.Scheme {
+	case "http", "ws":
+		wsScheme, apiScheme = "ws", "http"
+	case "https", "wss":
+		wsScheme, apiScheme = "wss", "https"
+	default:
+		return endpoint{}, fmt.Errorf("unsupported scheme %q, use http or https", base.Scheme)
+	}
+	return endpoint{
+		websocket: &url.URL{Scheme: wsScheme, User: base.User, Host: base.Host, Path: websocketPath},
+		api:       &url.URL{Scheme: apiScheme, User: base.User, Host: base.Host, Path: apiPath}}, nil
+}
+
+// legacyEndpoint makes the endpoint from host and ssl flag, the host
+// "hassio" uses the old hassio proxy paths
+func legacyEndpoint(host string, ssl bool) endpoint {
+	wsScheme, apiScheme := "ws", "http"
+	if ssl {
+		wsScheme, apiScheme = "wss", "https"
+	}
+	if host == "hassio" {
+		return endpoint{
+			websocket: &url.URL{Scheme: "ws", Host: host, Path: "/homeassistant/websocket"},
+			api:       &url.URL{Scheme: apiScheme, Host: host, Path: "/homeassistant/api"}}
+	}
+	return endpoint{
+		websocket: &url.URL{Scheme: wsScheme, Host: host, Path: "/api/websocket"},
+		api:       &url.URL{Scheme: apiScheme, Host: host, Path: "/api"}}
+}
+
+// websocketURL returns the url of the websocket API
+func (a endpoint) websocketURL() string {
+	if a.websocket == nil {
+		return ""
+	}
+	return a.websocket.String()
+}
+
+// apiURL returns the url of an escaped REST API path like
+// "states/light.kitchen" with the query, if any
+func (a endpoint) apiURL(apiPath string, query url.Values) string {
+	if a.api == nil {
+		return ""
+	}
+	u := *a.api
+	u.RawPath = strings.TrimSuffix(a.api.EscapedPath(), "/") + "/" + strings.TrimPrefix(apiPath, "/")
+	path, err := url.PathUnescape(u.RawPath)
+	if err != nil {
+		path = u.RawPath
+	}
+	u.Path = path
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RegistryEntry is an entity of the Home Assistant entity registry
+type RegistryEntry struct {
+	EntityID string `json:"entity_id"`
+	// UniqueID is the id given by the integration, stays the same when the
+	// entity id is changed
+	UniqueID      string `json:"unique_id"`
+	Platform      string `json:"platform"`
+	ConfigEntryID string `json:"config_entry_id"`
+	DeviceID      string `json:"device_id"`
+	// AreaID is set if the entity has another area than its device
+	AreaID string `json:"area_id"`
+	// EntityCategory is "config" or "diagnostic" for entities that are not
+	// the primary function of the device
+	EntityCategory string `json:"entity_category"`
+	// Name is the name given by the user, if any
+	Name string `json:"name"`
+	// OriginalName is the name given by the integration
+	OriginalName string `json:"original_name"`
+	Icon         string `json:"icon"`
+	// DisabledBy is set to who disabled the entity, like "user"
+	DisabledBy string `json:"disabled_by"`
+	// HiddenBy is set to who hid the entity, like "user"
+	HiddenBy      string `json:"hidden_by"`
+	HasEntityName bool   `json:"has_entity_name"`
+}
+
+// EntityUpdate has the registry fields to change, nil fields are left as
+// is and empty strings clear the field
+type EntityUpdate struct {
+	Name       *string
+	Icon       *string
+	AreaID     *string
+	DisabledBy *string
+	HiddenBy   *string
+	// NewEntityID renames the entity, can not be cleared
+	NewEntityID *string
+}
+
+// updateEntityResult is the result of config/entity_registry/update
+type updateEntityResult struct {
+	EntityEntry RegistryEntry `json:"entity_entry"`
+}
+
+// ListEntries returns all entries of the entity registry
+func (a *Registry) ListEntries(ctx context.Context) ([]RegistryEntry, error) {
+	result, err := a.hass.sendCommand(ctx, map[string]interface{}{"type": "config/entity_registry/list"})
+	if err != nil {
+		return nil, err
+	}
+	var entries []RegistryEntry
+	if err := result.decodeResult(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode entity registry: %v", err)
+	}
+	if a.cached {
+		cached := make(map[string]RegistryEntry, len(entries))
+		for _, entry := range entries {
+			cached[entry.EntityID] = entry
+		}
+		a.m.Lock()
+		a.entities = cached
+		a.m.Unlock()
+	}
+	return entries, nil
+}
+
+// FetchEntry returns the entity registry entry from Home Assistant
+func (a *Registry) FetchEntry(ctx context.Context, entityID string) (RegistryEntry, error) {
+	result, err := a.hass.sendCommand(ctx, map[string]interface{}{
+		"type":      "config/entity_registry/get",
+		"entity_id": entityID})
+	if err != nil {
+		return RegistryEntry{}, err
+	}
+	var entry RegistryEntry
+	if err := result.decodeResult(&entry); err != nil {
+		return RegistryEntry{}, fmt.Errorf("failed to decode entity registry entry: %v", err)
+	}
+	a.cacheEntry(entityID, entry)
+	return entry, nil
+}
+
+// UpdateEntry changes the registry entry of the entity, like its
+// name, area or entity id
+func (a *Registry) UpdateEntry(ctx context.Context, entityID string, update EntityUpdate) (RegistryEntry, error) {
+	message := map[string]interface{}{
+		"type":      "config/entity_registry/update",
+		"entity_id": entityID}
+	setOptional(message, "name", update.Name)
+	setOptional(message, "icon", update.Icon)
+	setOptional(message, "area_id", update.AreaID)
+	setOptional(message, "disabled_by", update.DisabledBy)
+	setOptional(message, "hidden_by", update.HiddenBy)
+	if update.NewEntityID != nil {
+		message["new_entity_id"] = *update.NewEntityID
+	}
+
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return RegistryEntry{}, err
+	}
+	var updated updateEntityResult
+	if err := result.decodeResult(&updated); err != nil {
+		return RegistryEntry{}, fmt.Errorf("failed to decode entity registry entry: %v", err)
+	}
+	a.cacheEntry(entityID, updated.EntityEntry)
+	return updated.EntityEntry, nil
+}
+
+// RemoveEntry removes the entity from the entity registry
+func (a *Registry) RemoveEntry(ctx context.Context, entityID string) error {
+	_, err := a.hass.sendCommand(ctx, map[string]interface{}{
+		"type":      "config/entity_registry/remove",
+		"entity_id": entityID})
+	if err != nil {
+		return err
+	}
+	a.m.Lock()
+	delete(a.entities, entityID)
+	a.m.Unlock()
+	return nil
+}
+
+// cacheEntry stores the entry, entityID is the id before a rename
+func (a *Registry) cacheEntry(entityID string, entry RegistryEntry) {
+	if !a.cached {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	delete(a.entities, entityID)
+	a.entities[entry.EntityID] = entry
+}
+
+// GetEntry returns the cached registry entry of the entity, requires
+// WithRegistryCache
+func (a *Registry) GetEntry(entityID string) (RegistryEntry, bool) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	entry, ok := a.entities[entityID]
+	return entry, ok
+}
+
+// EntityArea returns the cached area of the entity, or of its device if the
+// entity has no own area, requires WithRegistryCache
+func (a *Registry) EntityArea(entityID string) (Area, bool) {
+	entry, ok := a.GetEntry(entityID)
+	if !ok {
+		return Area{}, false
+	}
+	areaID := entry.AreaID
+	if areaID == "" {
+		if device, ok := a.GetDevice(entry.DeviceID); ok {
+			areaID = device.AreaID
+		}
+	}
+	if areaID == "" {
+		return Area{}, false
+	}
+	return a.GetArea(areaID)
+}
+
+// EntitiesInArea returns the entities in the area sorted by id, like all
+// lights in the kitchen with domain "light". Empty domain returns all
+// entities in the area. Requires WithRegistryCache.
+func (a *Registry) EntitiesInArea(areaID string, domain string) []HassEntity {
+	a.m.RLock()
+	entityIDs := make([]string, 0)
+	for entityID := range a.entities {
+		if domain == "" || strings.HasPrefix(entityID, domain+".") {
+			entityIDs = append(entityIDs, entityID)
+		}
+	}
+	a.m.RUnlock()
+
+	entities := make([]HassEntity, 0)
+	for _, entityID := range entityIDs {
+		if area, ok := a.EntityArea(entityID); !ok || area.ID != areaID {
+			continue
+		}
+		if entity, ok := a.hass.GetEntity(entityID); ok {
+			entities = append(entities, *entity)
+		}
+	}
+	sort.Sort(ByID(entities))
+	return entities
+}
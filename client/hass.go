@@ -4,44 +4,95 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"time"
 
 	"github.com/helto4real/go-hassclient/internal/wsocket"
 	ws "github.com/helto4real/go-hassclient/internal/wsocket"
+	"github.com/helto4real/go-hassclient/transport"
 	"github.com/sirupsen/logrus"
 )
 
 var log *logrus.Entry
 
 // Used to mock the connection to websocket
-type connectWSFunction func(host, path string, ssl bool) ws.Connected
+type connectWSFunction func(url string, options ws.Options) ws.Connected
 
 var (
 	getConnected    connectWSFunction = connectWS
 	connectionDelay                   = time.Duration(5)
+	// Time to wait for the result of a command sent to Home Assistant
+	resultTimeout = 10 * time.Second
 )
 
+// ErrResultTimeout is returned when Home Assistant does not answer a command in time
+var ErrResultTimeout = errors.New("timeout waiting for result from Home Assistant")
+
+// ErrNotConnected is returned when sending without a connection to Home Assistant
+var ErrNotConnected = errors.New("not connected to Home Assistant")
+
 // HomeAssistant interface represents Home Assistant
 type HomeAssistant interface {
 	// Start daemon only use in main
 	Start(host string, ssl bool, token string) bool
+	// StartURL starts the daemon using the base url of Home Assistant, like
+	// https://example.com:8443/hass, only use in main
+	StartURL(baseURL string, token string) bool
+	// StartAddon starts the daemon as an add-on using the Supervisor
+	// provided token, only use in main
+	StartAddon() bool
 	// Stop daemon only use in main
 	Stop()
 	GetEntity(entity string) (*HassEntity, bool)
-	SetEntity(entity *HassEntity) bool
-	CallService(service string, serviceData map[string]string)
+	// SetEntity sets the state of the entity and returns the state Home
+	// Assistant stored
+	SetEntity(entity *HassEntity) (SetEntityResult, error)
+	// CallService calls a service and returns the context id of the call,
+	// blocks for up to 10 seconds waiting for the result
+	CallService(service string, serviceData map[string]string) (string, error)
+	// CallServiceContext makes a service call, the context limits the time
+	// waiting to send the command and for its result
+	CallServiceContext(ctx context.Context, service string, serviceData map[string]string) (string, error)
+	// QueueDepth returns the number of messages waiting to be sent
+	QueueDepth() int
+	// CallServiceQueued makes a service call that is queued while not
+	// connected, requires an offline queue
+	CallServiceQueued(service string, serviceData map[string]string, options QueueOptions) (string, error)
+	// SetEntityQueued sets the entity state, queued while not connected,
+	// requires an offline queue
+	SetEntityQueued(entity *HassEntity, options QueueOptions) error
+	// QueuedCommands returns the number of commands waiting for connection
+	QueuedCommands() int
+	// CompressionStats returns the websocket traffic, use to see the effect
+	// of WithCompression
+	CompressionStats() CompressionStats
+	// REST returns a client for the REST API of the started Home Assistant
+	REST() *RestClient
+	// Recorder returns the history, logbook and statistics
+	Recorder() *Recorder
+	// Registry returns the area, device and entity registries
+	Registry() *Registry
+	// VirtualEntities returns the manager of entities owned by the daemon
+	VirtualEntities() *VirtualEntities
 	GetHassChannel() chan interface{}
 	GetStatusChannel() chan bool
 	GetConfig() *HassConfig
+	// Ping sends a ping to Home Assistant and returns the round-trip time,
+	// ErrNotConnected until authenticated
+	Ping() (time.Duration, error)
+	// Latency returns the round-trip time of the last successful ping
+	Latency() time.Duration
 }
 
 // HassHTTPPoster interface is for mocking the http post to Hass API
 type HassHTTPPoster interface {
-	HassHTTPPostAPI(url string, data []byte) bool
+	HassHTTPPostAPI(url string, data []byte) (int, []byte, error)
 }
 
 // homeAssistantPlatform implements integration with Home Assistant
@@ -56,12 +107,55 @@ type homeAssistantPlatform struct {
 	HassChannel       chan interface{}
 	HassStatusChannel chan bool
 	list              List
-	host              string
-	ssl               bool
+	endpoint          endpoint
 	stopped           bool
 	httpClient        *http.Client
 	HassConfig        *HassConfig
 	poster            HassHTTPPoster
+	pending           map[int64]chan Result
+	pendingMutex      sync.Mutex
+	wsOptions         ws.Options
+	// Location of HassConfig, stored separately as it is read while
+	// handling messages
+	configLocation atomic.Value
+
+	subscriptions       map[int64]*subscription
+	subscriptionsMutex  sync.Mutex
+	subscribeEntities   bool
+	subscribeEntitiesID int64
+	entitiesSynced      bool
+	coalesceMessages    bool
+
+	wsMutex          sync.RWMutex
+	authenticated    int32
+	lastMessage      int64
+	latency          int64
+	pinging          int32
+	watchdogInterval time.Duration
+	watchdogTimeout  time.Duration
+
+	dialer transport.Dialer
+	header http.Header
+
+	ready        int32
+	offlineQueue *offlineQueue
+	// Update the entity list with the result of SetEntity
+	localEntityUpdate bool
+	virtualEntities   *VirtualEntities
+	registry          *Registry
+	recorder          *Recorder
+}
+
+// Option configures the Home Assistant client
+type Option func(*homeAssistantPlatform)
+
+// WithMaxMessageSize sets the maximum size in bytes of a message from Home
+// Assistant. Large installations may need more than the default 3.4MB for
+// the result of get_states.
+func WithMaxMessageSize(size int64) Option {
+	return func(a *homeAssistantPlatform) {
+		a.wsOptions.MaxMessageSize = size
+	}
 }
 
 // ServiceDataItem is used for a convenient way to provide service data in a variadic function CallService
@@ -70,17 +164,49 @@ type ServiceDataItem struct {
 	Value string
 }
 
+// WithSubscribeEntities syncs states using the subscribe_entities command
+// instead of get_states and state_changed events. Changes are sent in a
+// compressed format that uses a fraction of the bandwidth.
+func WithSubscribeEntities() Option {
+	return func(a *homeAssistantPlatform) {
+		a.subscribeEntities = true
+	}
+}
+
+// WithCoalesceMessages asks Home Assistant to send many messages in one
+// websocket frame, reducing the overhead on installations with many events
+func WithCoalesceMessages() Option {
+	return func(a *homeAssistantPlatform) {
+		a.coalesceMessages = true
+	}
+}
+
+// WithWatchdog pings Home Assistant every interval and reconnects if no
+// message has been received within timeout. Timeout should be larger than
+// the interval.
+func WithWatchdog(interval, timeout time.Duration) Option {
+	return func(a *homeAssistantPlatform) {
+		a.watchdogInterval = interval
+		a.watchdogTimeout = timeout
+	}
+}
+
 // NewHassClientFakeConnection only used for mocking real connectio to Hass
-func NewHassClientFakeConnection(fakeConnection wsocket.Connected, fakePoster HassHTTPPoster) HomeAssistant {
+//
+// The connection is internal, use NewHassClientConnection outside this module
+func NewHassClientFakeConnection(fakeConnection wsocket.Connected, fakePoster HassHTTPPoster, options ...Option) HomeAssistant {
 	client := newHassClient()
-	client.wsClient = fakeConnection
+	client.setConnection(fakeConnection)
 	client.poster = fakePoster
+	for _, option := range options {
+		option(client)
+	}
 	return client
 }
 
 func newHassClient() *homeAssistantPlatform {
 	context, cancelHassLoop := context.WithCancel(context.Background())
-	return &homeAssistantPlatform{
+	client := &homeAssistantPlatform{
 		wsID:              1,
 		context:           context,
 		cancelHassLoop:    cancelHassLoop,
@@ -89,12 +215,23 @@ func newHassClient() *homeAssistantPlatform {
 		list:              NewEntityList(),
 		stopped:           false,
 		HassConfig:        &HassConfig{},
+		pending:           make(map[int64]chan Result),
+		subscriptions:     make(map[int64]*subscription),
+		wsOptions:         ws.Options{Stats: &ws.Stats{}},
 		httpClient:        &http.Client{}}
+	client.virtualEntities = newVirtualEntities(client)
+	client.registry = newRegistry(client)
+	client.recorder = &Recorder{hass: client}
+	return client
 }
 
 // NewHassClient creates a new instance of the Home Assistant client
-func NewHassClient() HomeAssistant {
-	return newHassClient()
+func NewHassClient(options ...Option) HomeAssistant {
+	client := newHassClient()
+	for _, option := range options {
+		option(client)
+	}
+	return client
 }
 
 func (a *homeAssistantPlatform) GetConfig() *HassConfig {
@@ -110,12 +247,43 @@ func (a *homeAssistantPlatform) GetStatusChannel() chan bool {
 }
 
 // Start the Home Assistant Client, use nil for fake, only for testing
+//
+// Without host the client is started as an add-on if running in one
 func (a *homeAssistantPlatform) Start(host string, ssl bool, token string) bool {
+	if host == "" && InAddon() {
+		return a.StartAddon()
+	}
+	return a.start(legacyEndpoint(host, ssl), token)
+}
+
+// StartURL starts the Home Assistant client using the base url
+//
+// Without base url the client is started as an add-on if running in one
+func (a *homeAssistantPlatform) StartURL(baseURL string, token string) bool {
+	if baseURL == "" && InAddon() {
+		return a.StartAddon()
+	}
+	endpoint, err := newEndpoint(baseURL)
+	if err != nil {
+		log.Errorf("Invalid Home Assistant url: %v", err)
+		return false
+	}
+	return a.start(endpoint, token)
+}
+
+func (a *homeAssistantPlatform) start(endpoint endpoint, token string) bool {
+	if err := a.checkTransport(); err != nil {
+		log.Error(err)
+		return false
+	}
 	a.token = token
-	a.host = host
-	a.ssl = ssl
-	if a.wsClient == nil {
-		a.wsClient = a.connectWithReconnect()
+	a.endpoint = endpoint
+	if a.connection() == nil {
+		a.setConnection(a.connectWithReconnect())
+	}
+	a.touch()
+	if a.watchdogInterval > 0 {
+		go a.watchdog()
 	}
 	if a.poster == nil {
 		a.poster = a
@@ -126,7 +294,7 @@ func (a *homeAssistantPlatform) Start(host string, ssl bool, token string) bool
 		case <-a.context.Done():
 			return false
 		default:
-			message, ok := a.wsClient.Read()
+			message, ok := a.connection().Read()
 
 			if !ok {
 				if a.stopped {
@@ -138,21 +306,22 @@ func (a *homeAssistantPlatform) Start(host string, ssl bool, token string) bool
 					return true
 				}
 
-				a.wsClient = a.connectWithReconnect()
-				if a.wsClient == nil {
+				// Subscriptions does not survive the connection
+				a.clearSubscriptions()
+				atomic.StoreInt32(&a.authenticated, 0)
+				atomic.StoreInt32(&a.ready, 0)
+				if a.offlineQueue != nil {
+					a.offlineQueue.holdAll()
+				}
+				a.setConnection(a.connectWithReconnect())
+				a.touch()
+				if a.connection() == nil {
 					log.Println("Ending service discovery")
 					return false
 				}
 			} else {
-				// s := string(message)
-				// fmt.Println(s)
-				var result Result
-				err := json.Unmarshal(message, &result)
-				if err != nil {
-					log.Error(err)
-				} else {
-					go a.handleMessage(result)
-				}
+				a.touch()
+				a.handleFrame(message)
 			}
 
 		}
@@ -160,6 +329,99 @@ func (a *homeAssistantPlatform) Start(host string, ssl bool, token string) bool
 	}
 
 }
+
+// handleFrame handles a websocket frame that is either a single message or,
+// when messages are coalesced, a list of messages
+func (a *homeAssistantPlatform) handleFrame(frame []byte) {
+	var results []Result
+	frame = bytes.TrimSpace(frame)
+	if len(frame) > 0 && frame[0] == '[' {
+		if err := json.Unmarshal(frame, &results); err != nil {
+			log.Error(err)
+			return
+		}
+	} else {
+		if a.handleStatesFrame(frame) {
+			return
+		}
+		var result Result
+		if err := json.Unmarshal(frame, &result); err != nil {
+			log.Error(err)
+			return
+		}
+		results = append(results, result)
+	}
+
+	// Messages of a coalesced frame are handled in order, like changes of
+	// the same entity. Results of commands are resolved right away so they
+	// do not wait behind events blocked on a full HassChannel.
+	messages := make([]Result, 0, len(results))
+	for _, result := range results {
+		if !a.dispatchEvent(result) && !a.dispatchResult(result) {
+			messages = append(messages, result)
+		}
+	}
+	if len(messages) == 0 {
+		return
+	}
+	go func() {
+		for _, message := range messages {
+			a.handleMessage(message)
+		}
+	}()
+}
+
+// handleStatesFrame handles the result of get_states straight from the
+// frame, returns false if the frame is not that result. The result may be
+// megabytes and is not copied out of the frame.
+func (a *homeAssistantPlatform) handleStatesFrame(frame []byte) bool {
+	id := atomic.LoadInt64(&a.getStateID)
+	if id == 0 {
+		return false
+	}
+	var header struct {
+		Id          int64  `json:"id"`
+		MessageType string `json:"type"`
+		Success     bool   `json:"success"`
+	}
+	if err := json.Unmarshal(frame, &header); err != nil || header.Id != id ||
+		header.MessageType != "result" || !header.Success {
+		return false
+	}
+	if !atomic.CompareAndSwapInt64(&a.getStateID, id, 0) {
+		return false
+	}
+	log.Debugf("Got all states, getting events [%v]", id)
+	go a.handleStates(func(handle func(StateData)) error {
+		return decodeStatesMessage(frame, handle)
+	})
+	return true
+}
+
+// handleStates adds the states decoded from the get_states result to the
+// entity list and subscribes to state changes
+func (a *homeAssistantPlatform) handleStates(decode func(handle func(StateData)) error) {
+	err := decode(func(data StateData) {
+		new, err := newHassEntityState(data, a.location())
+		if err != nil {
+			log.Errorf("Failed to decode state of %s: %v", data.EntityId, err)
+		}
+
+		old := HassEntityState{}
+		newHassEntity := NewHassEntity(data.EntityId, data.EntityId, old, new)
+		a.list.SetEntity(newHassEntity)
+		a.HassChannel <- *a.joinRegistry(newHassEntity)
+	})
+	if err != nil {
+		log.Errorf("Failed to decode get_states result: %v", err)
+		return
+	}
+
+	//			a.subscribeEventsCallService()
+	a.subscribeEventsStateChanged()
+	a.setReady()
+}
+
 func (a *homeAssistantPlatform) delay(seconds time.Duration) bool {
 
 	select {
@@ -172,29 +434,46 @@ func (a *homeAssistantPlatform) delay(seconds time.Duration) bool {
 
 // Stop the Home Assistant client
 func (a *homeAssistantPlatform) Stop() {
+	if a.virtualEntities.removeOnStop {
+		a.virtualEntities.removeAll()
+	}
 	a.stopped = true
 	a.cancelHassLoop()
-	if a.wsClient != nil {
-		a.wsClient.Close()
+	if client := a.connection(); client != nil {
+		client.Close()
 	}
 	close(a.HassChannel)
 	close(a.HassStatusChannel)
 }
 
 // connects to the websocket
-func connectWS(host, path string, ssl bool) ws.Connected {
-	return ws.ConnectWS(host, path, ssl)
+func connectWS(url string, options ws.Options) ws.Connected {
+	return ws.ConnectURL(url, options)
+}
+
+// connection returns the current websocket connection
+func (a *homeAssistantPlatform) connection() ws.Connected {
+	a.wsMutex.RLock()
+	defer a.wsMutex.RUnlock()
+	return a.wsClient
+}
+
+// setConnection replaces the current websocket connection
+func (a *homeAssistantPlatform) setConnection(client ws.Connected) {
+	a.wsMutex.Lock()
+	defer a.wsMutex.Unlock()
+	a.wsClient = client
 }
+
 func (a *homeAssistantPlatform) connectWithReconnect() ws.Connected {
 
 	var client ws.Connected
 
 	for {
-		if a.host == "hassio" {
-			client = getConnected(a.host, "/homeassistant/websocket", false)
-
+		if a.dialer != nil {
+			client = a.dialTransport(a.endpoint.websocketURL())
 		} else {
-			client = getConnected(a.host, "/api/websocket", a.ssl)
+			client = getConnected(a.endpoint.websocketURL(), a.wsOptions)
 		}
 
 		if client == nil {
@@ -213,101 +492,270 @@ func (a *homeAssistantPlatform) connectWithReconnect() ws.Connected {
 
 // GetEntity returns the entity
 func (a *homeAssistantPlatform) GetEntity(entity string) (*HassEntity, bool) {
-	return a.list.GetEntity(entity)
-}
-func (a *homeAssistantPlatform) HassHTTPPostAPI(url string, data []byte) bool {
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
-	if err == nil {
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+a.token)
-
-		resp, err := a.httpClient.Do(req)
-		if err == nil {
-			defer resp.Body.Close()
-			if resp.StatusCode == 200 || resp.StatusCode == 201 {
-				return true
-			}
-		}
+	hassEntity, ok := a.list.GetEntity(entity)
+	if ok {
+		a.joinRegistry(hassEntity)
 	}
-	return false
+	return hassEntity, ok
 }
 
-// SetEntity sets the entity to the map
-func (a *homeAssistantPlatform) SetEntity(entity *HassEntity) bool {
-	var scheme = "http"
-	if a.ssl == true {
-		scheme = "https"
-	}
-	var u url.URL
-	if a.host == "hassio" {
-		u = url.URL{Scheme: scheme, Host: a.host, Path: "/homeassistant/api/states/" + url.PathEscape(entity.ID)}
-	} else {
-		u = url.URL{Scheme: scheme, Host: a.host, Path: "/api/states/" + url.PathEscape(entity.ID)}
-	}
+// HassHTTPPostAPI posts the data and returns the status code and body of
+// the response
+func (a *homeAssistantPlatform) HassHTTPPostAPI(url string, data []byte) (int, []byte, error) {
+	return a.REST().send(context.Background(), "POST", url, data)
+}
 
-	stateData := SetStateData{State: entity.New.State, Attributes: entity.New.Attributes}
-	b, err := json.Marshal(stateData)
+// SetEntityResult is the state Home Assistant stored for an entity
+type SetEntityResult struct {
+	// Entity has the stored state in New, with the last_updated set by
+	// Home Assistant
+	Entity HassEntity
+	// Created is true if the entity did not exist before
+	Created bool
+}
 
-	if err != nil {
-		log.Errorf("Failed to marshal state data from entity %s, data : %v", entity, err)
-		return false
+// WithLocalEntityUpdate updates the entity list with the state stored by
+// SetEntity, without waiting for the state_changed event
+func WithLocalEntityUpdate() Option {
+	return func(a *homeAssistantPlatform) {
+		a.localEntityUpdate = true
 	}
+}
 
-	return a.poster.HassHTTPPostAPI(u.String(), b)
+// SetEntity sets the state of the entity in Home Assistant. Errors from
+// Home Assistant are returned as *APIError.
+//
+// With the offline queue the state is queued while not connected and
+// ErrQueued is returned
+func (a *homeAssistantPlatform) SetEntity(entity *HassEntity) (SetEntityResult, error) {
+	if a.offlineQueue != nil {
+		return a.setEntityQueued(entity, QueueOptions{})
+	}
+	return a.setEntity(entity)
+}
 
+func (a *homeAssistantPlatform) setEntity(entity *HassEntity) (SetEntityResult, error) {
+	result, err := a.REST().SetState(context.Background(), entity.ID, entity.New.State, entity.New.Attributes)
+	if err != nil {
+		return SetEntityResult{}, err
+	}
+	old := HassEntityState{}
+	if current, ok := a.list.GetEntity(entity.ID); ok {
+		old = current.New
+	}
+	stored := NewHassEntity(entity.ID, entity.ID, old, result.Entity.New)
+	if a.localEntityUpdate {
+		a.list.SetEntity(stored)
+	}
+	result.Entity = *stored
+	return result, nil
 }
 
 //CallService makes a service call through the Home Assistant API
-func (a *homeAssistantPlatform) CallService(service string, serviceData map[string]string) {
-	a.wsID = a.wsID + 1
+//
+// Returns the id of the context Home Assistant created for the call. State
+// changes caused by the call will carry the same context id. Blocks until
+// Home Assistant answers, ErrResultTimeout is returned after 10 seconds.
+func (a *homeAssistantPlatform) CallService(service string, serviceData map[string]string) (string, error) {
+	return a.CallServiceContext(context.Background(), service, serviceData)
+}
+
+// CallServiceContext makes a service call through the Home Assistant API
+//
+// With the offline queue the call is queued while not connected, the
+// deadline of the context is then the TTL of the queued call
+func (a *homeAssistantPlatform) CallServiceContext(ctx context.Context, service string, serviceData map[string]string) (string, error) {
+	if a.offlineQueue != nil {
+		return a.callServiceQueued(ctx, service, serviceData, QueueOptions{})
+	}
+	return a.callService(ctx, service, serviceData)
+}
 
+func (a *homeAssistantPlatform) callService(ctx context.Context, service string, serviceData map[string]string) (string, error) {
 	s := map[string]interface{}{
-		"id":           a.wsID,
 		"type":         "call_service",
 		"domain":       "homeassistant",
 		"service":      service,
 		"service_data": serviceData}
 
-	a.wsClient.SendMap(s)
+	result, err := a.sendCommand(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	var data CallServiceResult
+	// Older versions of Home Assistant returns null as result
+	if len(result.Result) > 0 {
+		if err := result.decodeResult(&data); err != nil {
+			return "", err
+		}
+	}
+	return data.Context.ID, nil
+}
+
+// nextID returns a new unique message id for the websocket API
+func (a *homeAssistantPlatform) nextID() int64 {
+	return atomic.AddInt64(&a.wsID, 1)
+}
+
+// QueueDepth returns the number of messages waiting to be sent
+func (a *homeAssistantPlatform) QueueDepth() int {
+	if client := a.connection(); client != nil {
+		return client.QueueDepth()
+	}
+	return 0
+}
+
+// send a message without waiting for the result, errors are logged
+func (a *homeAssistantPlatform) send(message map[string]interface{}) {
+	client := a.connection()
+	if client == nil {
+		log.Errorf("Failed to send %s: %v", message["type"], ErrNotConnected)
+		return
+	}
+	if err := client.SendMap(a.context, message); err != nil {
+		log.Errorf("Failed to send %s: %v", message["type"], err)
+	}
+}
+
+// sendCommand sends a command to Home Assistant and waits for the result
+func (a *homeAssistantPlatform) sendCommand(ctx context.Context, message map[string]interface{}) (Result, error) {
+	id, ok := message["id"].(int64)
+	if !ok {
+		id = a.nextID()
+		message["id"] = id
+	}
+
+	resultChannel := make(chan Result, 1)
+	a.pendingMutex.Lock()
+	a.pending[id] = resultChannel
+	a.pendingMutex.Unlock()
+
+	defer func() {
+		a.pendingMutex.Lock()
+		delete(a.pending, id)
+		a.pendingMutex.Unlock()
+	}()
+
+	client := a.connection()
+	if client == nil {
+		return Result{}, ErrNotConnected
+	}
+	if err := client.SendMap(ctx, message); err != nil {
+		return Result{}, err
+	}
+
+	timeout := time.NewTimer(resultTimeout)
+	defer timeout.Stop()
+
+	select {
+	case result := <-resultChannel:
+		if result.MessageType == "result" && !result.Success {
+			return result, fmt.Errorf("%s failed: %s (%s)", message["type"], result.Error.Message, result.Error.Code)
+		}
+		return result, nil
+	case <-timeout.C:
+		return Result{}, ErrResultTimeout
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case <-a.context.Done():
+		return Result{}, a.context.Err()
+	}
+}
+
+// resolvePending delivers the result to a waiting command, returns false if
+// no one waits for the result
+func (a *homeAssistantPlatform) resolvePending(message Result) bool {
+	a.pendingMutex.Lock()
+	defer a.pendingMutex.Unlock()
 
+	resultChannel, ok := a.pending[message.Id]
+	if ok {
+		resultChannel <- message
+		delete(a.pending, message.Id)
+	}
+	return ok
+}
+
+// dispatchResult resolves the result or pong of a command waiting for it,
+// returns false if no command is waiting
+func (a *homeAssistantPlatform) dispatchResult(message Result) bool {
+	if message.MessageType != "result" && message.MessageType != "pong" {
+		return false
+	}
+	return a.resolvePending(message)
 }
 
 // Send a generic message to Home Assistant websocket API
 func (a *homeAssistantPlatform) sendMessage(messageType string) {
-	a.wsID = a.wsID + 1
+	id := a.nextID()
 	s := map[string]interface{}{
-		"id":   a.wsID,
+		"id":   id,
 		"type": messageType}
 
 	if messageType == "get_states" {
-		a.getStateID = a.wsID
+		atomic.StoreInt64(&a.getStateID, id)
 	} else if messageType == "get_config" {
-		a.getConfigID = a.wsID
+		atomic.StoreInt64(&a.getConfigID, id)
 	}
-	a.wsClient.SendMap(s)
+	a.send(s)
 
 }
 
 func (a *homeAssistantPlatform) subscribeEventsStateChanged() {
-	a.wsID = a.wsID + 1
 	s := map[string]interface{}{
-		"id":   a.wsID,
+		"id":   a.nextID(),
 		"type": "subscribe_events"} //"event_type": "state_changed"
 
-	a.wsClient.SendMap(s)
+	a.send(s)
+
+}
+
+// sendSupportedFeatures tells Home Assistant what features the client
+// supports, must be the first message after authentication
+func (a *homeAssistantPlatform) sendSupportedFeatures() {
+	s := map[string]interface{}{
+		"id":   a.nextID(),
+		"type": "supported_features",
+		"features": map[string]interface{}{
+			"coalesce_messages": 1}}
+
+	a.send(s)
+}
+
+func (a *homeAssistantPlatform) subscribeEventsCallService() {
+	s := map[string]interface{}{
+		"id":         a.nextID(),
+		"type":       "subscribe_events",
+		"event_type": "call_service"}
+
+	a.send(s)
+
+}
+
+// subscribeEventsHomeAssistantStarted subscribes to the event sent when Home
+// Assistant has started, already included when subscribing to all events
+func (a *homeAssistantPlatform) subscribeEventsHomeAssistantStarted() {
+	s := map[string]interface{}{
+		"id":         a.nextID(),
+		"type":       "subscribe_events",
+		"event_type": "homeassistant_started"}
 
+	a.send(s)
 }
 
-// func (a *homeAssistantPlatform) subscribeEventsCallService() {
-// 	a.wsID = a.wsID + 1
-// 	s := map[string]interface{}{
-// 		"id":         a.wsID,
-// 		"type":       "subscribe_events",
-// 		"event_type": "call_service"}
+// subscribeEntities subscribes to all entity states in compressed format
+func (a *homeAssistantPlatform) subscribeEntitiesCompressed() {
+	id := a.nextID()
+	atomic.StoreInt64(&a.subscribeEntitiesID, id)
+	a.entitiesSynced = false
+	a.subscribe(id, a.handleCompressedEvent)
 
-// 	a.wsClient.SendMap(s)
+	s := map[string]interface{}{
+		"id":   id,
+		"type": "subscribe_entities"}
 
-// }
+	a.send(s)
+}
 
 func (a *homeAssistantPlatform) handleMessage(message Result) {
 
@@ -315,76 +763,120 @@ func (a *homeAssistantPlatform) handleMessage(message Result) {
 		//	log.Print("message->: ", message)
 		log.Debugln("Authorizing with Home Assistant...")
 
-		a.wsClient.SendString("{\"type\": \"auth\",\"access_token\": \"" + a.token + "\"}")
+		err := a.connection().SendString(a.context, "{\"type\": \"auth\",\"access_token\": \""+a.token+"\"}")
+		if err != nil {
+			log.Errorf("Failed to send auth: %v", err)
+		}
 	} else if message.MessageType == "auth_ok" {
 		//		log.Print("message->: ", message)
 		log.Debugln("Autorization ok...")
+		atomic.StoreInt32(&a.authenticated, 1)
+		if a.coalesceMessages {
+			a.sendSupportedFeatures()
+		}
 		a.sendMessage("get_config")
 
 	} else if message.MessageType == "result" {
 
-		if message.Id == a.getStateID {
-			log.Debugf("Got all states, getting events [%v]", message.Id)
-			results := message.Result.([]interface{})
-			for _, data := range results {
-				item := data.(map[string]interface{})
-				lastUpdated, _ := time.Parse(time.RFC3339, item["last_updated"].(string))
-				lastChanged, _ := time.Parse(time.RFC3339, item["last_changed"].(string))
-				new := HassEntityState{
-					LastUpdated: lastUpdated,
-					LastChanged: lastChanged,
-					State:       item["state"].(string),
-					Attributes:  item["attributes"].(map[string]interface{})}
-
-				old := HassEntityState{}
-				newHassEntity := NewHassEntity(item["entity_id"].(string), item["entity_id"].(string), old, new)
-				a.list.SetEntity(newHassEntity)
-				a.HassChannel <- *newHassEntity
+		if a.resolvePending(message) {
+			return
+		}
 
+		if message.Id == atomic.LoadInt64(&a.subscribeEntitiesID) && message.Success {
+			// State changes comes through subscribe_entities, still want
+			// to notify service calls
+			a.subscribeEventsCallService()
+			a.subscribeEventsHomeAssistantStarted()
+			if a.registry.cached {
+				a.subscribeEventsRegistryUpdated()
 			}
+			return
+		} else if message.Id == atomic.LoadInt64(&a.subscribeEntitiesID) {
+			// Versions before 2022.4 does not support subscribe_entities
+			log.Warnf("subscribe_entities failed (%s), using get_states", message.Error.Message)
+			a.unsubscribe(message.Id)
+			a.subscribeEntities = false
+			a.sendMessage("get_states")
+			return
+		}
 
-			//			a.subscribeEventsCallService()
-			a.subscribeEventsStateChanged()
-			log.Info("Home Assistant integration ready!")
-			a.HassStatusChannel <- true
-		} else if message.Id == a.getConfigID {
-
-			result := message.Result.(map[string]interface{})
-			a.HassConfig.Latitude = result["latitude"].(float64)
-			a.HassConfig.Longitude = result["longitude"].(float64)
-			a.HassConfig.Elevation = result["elevation"].(float64)
+		if message.Id == atomic.LoadInt64(&a.getStateID) {
+			log.Debugf("Got all states, getting events [%v]", message.Id)
+			a.handleStates(func(handle func(StateData)) error {
+				return decodeStates(message.Result, handle)
+			})
+		} else if message.Id == atomic.LoadInt64(&a.getConfigID) {
+
+			var result ConfigData
+			if err := message.decodeResult(&result); err != nil {
+				log.Errorf("Failed to decode get_config result: %v", err)
+				return
+			}
+			a.HassConfig.Latitude = result.Latitude
+			a.HassConfig.Longitude = result.Longitude
+			a.HassConfig.Elevation = result.Elevation
+			a.HassConfig.TimeZone = result.TimeZone
+			location, err := time.LoadLocation(result.TimeZone)
+			if err != nil {
+				log.Warnf("Unknown time zone %q, using UTC: %v", result.TimeZone, err)
+				location = time.UTC
+			}
+			a.setLocation(location)
 
-			a.sendMessage("get_states")
+			if a.subscribeEntities {
+				a.subscribeEntitiesCompressed()
+			} else {
+				a.sendMessage("get_states")
+			}
 
 		}
+	} else if message.MessageType == "pong" {
+		a.resolvePending(message)
 	} else if message.MessageType == "event" {
-		if message.Event.EventType == "state_changed" {
-			data := message.Event.Data
+		var event Event
+		if err := message.decodeEvent(&event); err != nil {
+			log.Errorf("Failed to decode event: %v", err)
+			return
+		}
+		if event.EventType == "state_changed" {
+			var data StateChangedData
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				log.Errorf("Failed to decode state_changed event: %v", err)
+				return
+			}
 			log.Tracef("message->: %s=%s", data.EntityId, data.NewState.State)
-			lastUpdated, _ := time.Parse(time.RFC3339, data.NewState.LastUpdated)
-			lastChanged, _ := time.Parse(time.RFC3339, data.NewState.LastChanged)
-			new := HassEntityState{
-				LastUpdated: lastUpdated,
-				LastChanged: lastChanged,
-				State:       fmt.Sprint(data.NewState.State),
-				Attributes:  data.NewState.Attributes}
-			lastUpdated, _ = time.Parse(time.RFC3339, data.OldState.LastUpdated)
-			lastChanged, _ = time.Parse(time.RFC3339, data.OldState.LastChanged)
-
-			old := HassEntityState{
-				LastUpdated: lastUpdated,
-				LastChanged: lastChanged,
-				State:       fmt.Sprint(data.OldState.State),
-				Attributes:  data.OldState.Attributes}
+			new, err := newHassEntityState(data.NewState, a.location())
+			if err != nil {
+				log.Errorf("Failed to decode new state of %s: %v", data.EntityId, err)
+			}
+			old, err := newHassEntityState(data.OldState, a.location())
+			if err != nil {
+				log.Errorf("Failed to decode old state of %s: %v", data.EntityId, err)
+			}
 
 			newHassEntity := NewHassEntity(data.EntityId, data.EntityId, old, new)
 			a.list.SetEntity(newHassEntity)
-			a.HassChannel <- *newHassEntity
-		} else if message.Event.EventType == "call_service" {
-
-			timeFired, _ := time.Parse(time.RFC3339, message.Event.TimeFired)
-			newHassCallServiceEvent := NewHassCallServiceEvent(timeFired, message.Event.Data.Domain,
-				message.Event.Data.Service, message.Event.Data.ServiceData)
+			a.virtualEntities.changed(data.EntityId, new)
+			a.HassChannel <- *a.joinRegistry(newHassEntity)
+		} else if strings.HasSuffix(event.EventType, "_registry_updated") {
+			a.registry.handleEvent(event)
+		} else if event.EventType == "homeassistant_started" {
+			log.Debugln("Home Assistant started, publishing virtual entities")
+			a.virtualEntities.publishAll()
+		} else if event.EventType == "call_service" {
+			var data CallServiceData
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				log.Errorf("Failed to decode call_service event: %v", err)
+				return
+			}
+			timeFired, err := parseHassTime(event.TimeFired, a.location())
+			if err != nil {
+				log.Errorf("Failed to decode call_service event: time_fired: %v", err)
+			}
+			newHassCallServiceEvent := NewHassCallServiceEvent(timeFired, data.Domain,
+				data.Service, data.ServiceData)
+			newHassCallServiceEvent.Origin = event.Origin
+			newHassCallServiceEvent.Context = event.Context.hassContext()
 			a.HassChannel <- *newHassCallServiceEvent
 
 		}
@@ -1,7 +1,13 @@
 package client
 
+import "time"
+
 type HassConfig struct {
 	Longitude float64
 	Latitude  float64
 	Elevation float64
+	// TimeZone is the time zone name configured in Home Assistant
+	TimeZone string
+	// Location is the loaded TimeZone, all timestamps are converted to it
+	Location *time.Location
 }
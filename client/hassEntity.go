@@ -5,11 +5,31 @@ import (
 	"time"
 )
 
+// HassContext identifies what caused a state change or event in Home Assistant
+type HassContext struct {
+	ID       string
+	UserID   string
+	ParentID string
+}
+
+// ByUser returns true if a logged in user caused the change
+func (a HassContext) ByUser() bool {
+	return a.UserID != ""
+}
+
+// ByAutomation returns true if the change was caused by another event,
+// like an automation or script
+func (a HassContext) ByAutomation() bool {
+	return a.UserID == "" && a.ParentID != ""
+}
+
 type HassEntityState struct {
-	LastUpdated time.Time
-	LastChanged time.Time
-	State       string
-	Attributes  map[string]interface{}
+	LastUpdated  time.Time
+	LastChanged  time.Time
+	LastReported time.Time
+	State        string
+	Attributes   map[string]interface{}
+	Context      HassContext
 }
 
 type HassEntity struct {
@@ -17,6 +37,10 @@ type HassEntity struct {
 	Name string
 	New  HassEntityState
 	Old  HassEntityState
+	// Registry is the entity registry entry when using WithRegistryCache
+	// and the entity is registered. Set by GetEntity, EntitiesInArea and
+	// on HassChannel, it is a snapshot and not updated later.
+	Registry *RegistryEntry
 }
 
 func NewHassEntity(id string, name string, old HassEntityState, new HassEntityState) *HassEntity {
@@ -33,6 +57,8 @@ type HassCallServiceEvent struct {
 	Domain      string
 	Service     string
 	ServiceData map[string]interface{}
+	Origin      string
+	Context     HassContext
 }
 
 func NewHassCallServiceEvent(timeFired time.Time, domain string, service string, serviceData map[string]interface{}) *HassCallServiceEvent {
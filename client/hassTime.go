@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Layouts Home Assistant has used for timestamps, tried in order
+var hassTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseHassTime parses a timestamp from Home Assistant and converts it to
+// given location. Missing timestamps returns zero time without error.
+func parseHassTime(value string, location *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range hassTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			if location != nil {
+				t = t.In(location)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("malformed timestamp %q", value)
+}
+
+// newHassEntityState decodes the state data from Home Assistant. A malformed
+// timestamp is left as zero time and reported in the error, the rest of the
+// state is still returned.
+func newHassEntityState(data StateData, location *time.Location) (HassEntityState, error) {
+	state := HassEntityState{
+		State:      fmt.Sprint(data.State),
+		Attributes: data.Attributes,
+		Context:    data.Context.hassContext()}
+
+	if data.State == nil {
+		state.State = ""
+	}
+	var errs []string
+	parse := func(name string, value string) time.Time {
+		t, err := parseHassTime(value, location)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+		return t
+	}
+	state.LastUpdated = parse("last_updated", data.LastUpdated)
+	state.LastChanged = parse("last_changed", data.LastChanged)
+	state.LastReported = parse("last_reported", data.LastReported)
+	// Older versions of Home Assistant do not send last_reported
+	if state.LastReported.IsZero() {
+		state.LastReported = state.LastUpdated
+	}
+	if len(errs) > 0 {
+		return state, errors.New(strings.Join(errs, ", "))
+	}
+	return state, nil
+}
+
+// location returns the time zone of Home Assistant, nil until the config is
+// received
+func (a *homeAssistantPlatform) location() *time.Location {
+	location, _ := a.configLocation.Load().(*time.Location)
+	return location
+}
+
+// setLocation stores the time zone of Home Assistant
+func (a *homeAssistantPlatform) setLocation(location *time.Location) {
+	a.configLocation.Store(location)
+	a.HassConfig.Location = location
+}
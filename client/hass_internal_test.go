@@ -2,11 +2,21 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -69,6 +79,38 @@ func TestConnectReconnect(t *testing.T) {
 	}
 }
 
+func TestWatchdogReconnectsStaleConnection(t *testing.T) {
+	hass := NewHassClient(WithWatchdog(time.Millisecond*10, time.Millisecond*50)).(*homeAssistantPlatform)
+	hass.poster = newFakePoster()
+
+	oldGetConnected := getConnected
+	oldConnectionDelay := connectionDelay
+	var nrOfConnects int64
+	getConnected = func(url string, options ws.Options) ws.Connected {
+		atomic.AddInt64(&nrOfConnects, 1)
+		return newFakeConnected()
+	}
+	connectionDelay = 0
+	defer func() {
+		getConnected = oldGetConnected
+		connectionDelay = oldConnectionDelay
+	}()
+
+	go hass.Start("host", false, "token")
+	defer hass.Stop()
+
+	// The fake connection never sends anything so the watchdog should
+	// force a reconnect after the timeout
+	time.Sleep(time.Millisecond * 300)
+	h.Equals(t, true, atomic.LoadInt64(&nrOfConnects) >= 2)
+}
+
+func TestPingBeforeAuthenticated(t *testing.T) {
+	hass := newHassClient()
+	_, err := hass.Ping()
+	h.Equals(t, ErrNotConnected, err)
+}
+
 func TestDisconnectAndReconnect(t *testing.T) {
 	if !*h.IntegrationFlag {
 		t.Skip()
@@ -93,6 +135,696 @@ func TestDisconnectAndReconnect(t *testing.T) {
 
 }
 
+func TestParseHassTime(t *testing.T) {
+	stockholm := time.FixedZone("CET", 3600)
+
+	t.Run("Microseconds",
+		func(*testing.T) {
+			parsed, err := parseHassTime("2019-02-17T11:43:47.090473+00:00", stockholm)
+			h.Ok(t, err)
+			h.Equals(t, 90473000, parsed.Nanosecond())
+			h.Equals(t, 12, parsed.Hour())
+			h.Equals(t, stockholm, parsed.Location())
+		})
+
+	t.Run("Empty",
+		func(*testing.T) {
+			parsed, err := parseHassTime("", stockholm)
+			h.Ok(t, err)
+			h.Equals(t, true, parsed.IsZero())
+		})
+
+	t.Run("Malformed",
+		func(*testing.T) {
+			_, err := parseHassTime("17/02/2019", stockholm)
+			h.NotEquals(t, nil, err)
+		})
+
+	t.Run("LastReportedDefaultsToLastUpdated",
+		func(*testing.T) {
+			state, err := newHassEntityState(StateData{
+				State:       "on",
+				LastUpdated: "2019-02-17T11:43:47+00:00",
+				LastChanged: "2019-02-17T11:41:08+00:00"}, time.UTC)
+			h.Ok(t, err)
+			h.Equals(t, state.LastUpdated, state.LastReported)
+		})
+
+	t.Run("MalformedState",
+		func(*testing.T) {
+			state, err := newHassEntityState(StateData{
+				State:       "on",
+				LastUpdated: "2019-02-17T11:43:47+00:00",
+				LastChanged: "yesterday"}, time.UTC)
+			h.NotEquals(t, nil, err)
+			// The state is kept with zero time for the malformed timestamp
+			h.Equals(t, "on", state.State)
+			h.Equals(t, true, state.LastChanged.IsZero())
+			h.Equals(t, 2019, state.LastUpdated.Year())
+		})
+}
+
+func TestHandleMessageUnexpectedPayload(t *testing.T) {
+	hass := newHassClient()
+	hass.getStateID = 2
+	hass.getConfigID = 3
+
+	// None of these should panic
+	hass.handleMessage(Result{Id: 2, MessageType: "result", Success: true, Result: json.RawMessage(`{"not":"a list"}`)})
+	hass.handleMessage(Result{Id: 3, MessageType: "result", Success: true, Result: json.RawMessage(`[1, 2, 3]`)})
+	hass.handleMessage(Result{MessageType: "event", Event: json.RawMessage(`{"event_type":"state_changed","data":[]}`)})
+	hass.handleMessage(Result{MessageType: "event", Event: json.RawMessage(`"garbage"`)})
+
+	_, ok := hass.GetEntity("light.any")
+	h.Equals(t, false, ok)
+}
+
+func TestCompressedResubscribe(t *testing.T) {
+	hass := newHassClient()
+	hass.list.SetEntity(NewHassEntity("light.kept", "light.kept", HassEntityState{}, HassEntityState{State: "on"}))
+	hass.list.SetEntity(NewHassEntity("light.gone", "light.gone", HassEntityState{}, HassEntityState{State: "on"}))
+
+	// First event after a resubscribe lacks the entity removed while
+	// disconnected
+	hass.handleCompressedEvent(Result{MessageType: "event", Event: json.RawMessage(
+		`{"a": {"light.kept": {"s": "off", "a": {}, "c": "01GX6W0CZ3MXNHE6S8R3BR2ZEQ", "lc": 1680697892.5}}}`)})
+	<-hass.GetStatusChannel()
+
+	entity, ok := hass.GetEntity("light.kept")
+	h.Equals(t, true, ok)
+	h.Equals(t, "off", entity.New.State)
+	_, ok = hass.GetEntity("light.gone")
+	h.Equals(t, false, ok)
+
+	<-hass.GetHassChannel()
+	removed := (<-hass.GetHassChannel()).(HassEntity)
+	h.Equals(t, "light.gone", removed.ID)
+	h.Equals(t, "", removed.New.State)
+
+	h.Equals(t, true, compressedTime(0, time.UTC).IsZero())
+}
+
+func TestHandleFrameInOrder(t *testing.T) {
+	hass := newHassClient()
+	event := func(old, new string) string {
+		return `{"id": 1, "type": "event", "event": {"event_type": "state_changed", "data": {"entity_id": "light.hall",
+			"old_state": {"state": "` + old + `"}, "new_state": {"state": "` + new + `"}}}}`
+	}
+	hass.handleFrame([]byte("[" + event("off", "on") + "," + event("on", "dimmed") + "]"))
+
+	first := (<-hass.GetHassChannel()).(HassEntity)
+	h.Equals(t, "on", first.New.State)
+	second := (<-hass.GetHassChannel()).(HassEntity)
+	h.Equals(t, "dimmed", second.New.State)
+
+	entity, ok := hass.GetEntity("light.hall")
+	h.Equals(t, true, ok)
+	h.Equals(t, "dimmed", entity.New.State)
+}
+
+func TestHandleFrameResultNotBlocked(t *testing.T) {
+	hass := newHassClient()
+	for i := 0; i < cap(hass.HassChannel); i++ {
+		hass.HassChannel <- i
+	}
+	resultChannel := make(chan Result, 1)
+	hass.pending[5] = resultChannel
+
+	event := `{"id": 1, "type": "event", "event": {"event_type": "state_changed", "data": {"entity_id": "light.hall",
+		"old_state": {"state": "off"}, "new_state": {"state": "on"}}}}`
+	hass.handleFrame([]byte("[" + event + `, {"id": 5, "type": "result", "success": true, "result": null}]`))
+
+	select {
+	case result := <-resultChannel:
+		h.Equals(t, int64(5), result.Id)
+	case <-time.After(time.Second):
+		t.Fatal("result waited behind the blocked event")
+	}
+	hass.cancelHassLoop()
+	for len(hass.HassChannel) > 0 {
+		<-hass.HassChannel
+	}
+}
+
+func TestDispatchEventNotBlocked(t *testing.T) {
+	hass := newHassClient()
+	defer hass.cancelHassLoop()
+	release := make(chan struct{})
+	handled := make(chan string, 200)
+	hass.subscribe(7, func(event Result) {
+		<-release
+		handled <- string(event.Event)
+	})
+
+	// More events than any buffer while the handler is stuck
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			hass.dispatchEvent(Result{Id: 7, MessageType: "event", Event: json.RawMessage(strconv.Itoa(i))})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatchEvent blocked on a slow subscription")
+	}
+
+	close(release)
+	for i := 0; i < 200; i++ {
+		h.Equals(t, strconv.Itoa(i), <-handled)
+	}
+}
+
+func TestDecodeStates(t *testing.T) {
+	var result Result
+	data, _ := ioutil.ReadFile("testdata/result_states.json")
+	h.Ok(t, json.Unmarshal(data, &result))
+
+	var ids []string
+	err := decodeStates(result.Result, func(state StateData) {
+		ids = append(ids, state.EntityId)
+	})
+	h.Ok(t, err)
+	h.Equals(t, 19, len(ids))
+	h.Equals(t, "zone.test", ids[0])
+
+	err = decodeStates([]byte(`{"entity_id": "light.not_a_list"}`), func(state StateData) {})
+	h.NotEquals(t, nil, err)
+
+	// Straight from the message
+	ids = nil
+	err = decodeStatesMessage(data, func(state StateData) {
+		ids = append(ids, state.EntityId)
+	})
+	h.Ok(t, err)
+	h.Equals(t, 19, len(ids))
+	err = decodeStatesMessage([]byte(`{"id": 1, "type": "result"}`), func(state StateData) {})
+	h.NotEquals(t, nil, err)
+}
+
+func TestWithMaxMessageSize(t *testing.T) {
+	hass := NewHassClient(WithMaxMessageSize(10000000)).(*homeAssistantPlatform)
+	h.Equals(t, int64(10000000), hass.wsOptions.MaxMessageSize)
+}
+
+// legacyResult is how results were decoded before typed decoding
+type legacyResult struct {
+	Id          int64       `json:"id"`
+	MessageType string      `json:"type"`
+	Success     bool        `json:"success"`
+	Result      interface{} `json:"result"`
+}
+
+// largeStatesResult makes a get_states result with given number of states
+func largeStatesResult(tb testing.TB, count int) []byte {
+	var result Result
+	data, _ := ioutil.ReadFile("testdata/result_states.json")
+	h.Ok(tb, json.Unmarshal(data, &result))
+
+	var states []map[string]interface{}
+	h.Ok(tb, json.Unmarshal(result.Result, &states))
+
+	large := make([]map[string]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		state := map[string]interface{}{}
+		for key, value := range states[i%len(states)] {
+			state[key] = value
+		}
+		state["entity_id"] = fmt.Sprintf("sensor.benchmark_%d", i)
+		large = append(large, state)
+	}
+	message, err := json.Marshal(map[string]interface{}{
+		"id": 1, "type": "result", "success": true, "result": large})
+	h.Ok(tb, err)
+	return message
+}
+
+func BenchmarkDecodeStatesGeneric(b *testing.B) {
+	message := largeStatesResult(b, 5000)
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		list := NewEntityList()
+		var result legacyResult
+		if err := json.Unmarshal(message, &result); err != nil {
+			b.Fatal(err)
+		}
+		for _, data := range result.Result.([]interface{}) {
+			item := data.(map[string]interface{})
+			lastUpdated, _ := time.Parse(time.RFC3339, item["last_updated"].(string))
+			lastChanged, _ := time.Parse(time.RFC3339, item["last_changed"].(string))
+			new := HassEntityState{
+				LastUpdated: lastUpdated,
+				LastChanged: lastChanged,
+				State:       item["state"].(string),
+				Attributes:  item["attributes"].(map[string]interface{})}
+			list.SetEntity(NewHassEntity(item["entity_id"].(string), item["entity_id"].(string), HassEntityState{}, new))
+		}
+	}
+}
+
+func BenchmarkDecodeStatesStreaming(b *testing.B) {
+	message := largeStatesResult(b, 5000)
+	b.SetBytes(int64(len(message)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		list := NewEntityList()
+		err := decodeStatesMessage(message, func(data StateData) {
+			new, _ := newHassEntityState(data, time.UTC)
+			list.SetEntity(NewHassEntity(data.EntityId, data.EntityId, HassEntityState{}, new))
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Custom") != "custom" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	t.Run("TrustedCA",
+		func(*testing.T) {
+			hass := NewHassClient(WithConnectionConfig(ConnectionConfig{
+				TLSConfig: &tls.Config{RootCAs: pool},
+				Header:    http.Header{"X-Custom": []string{"custom"}},
+			})).(*homeAssistantPlatform)
+			hass.token = "token"
+
+			statusCode, _, err := hass.HassHTTPPostAPI(server.URL, []byte("{}"))
+			h.Ok(t, err)
+			h.Equals(t, http.StatusCreated, statusCode)
+		})
+
+	t.Run("UnknownCA",
+		func(*testing.T) {
+			hass := newHassClient()
+			hass.token = "token"
+
+			_, _, err := hass.HassHTTPPostAPI(server.URL, []byte("{}"))
+			h.NotEquals(t, nil, err)
+		})
+
+	t.Run("WebsocketOptions",
+		func(*testing.T) {
+			hass := NewHassClient(WithConnectionConfig(ConnectionConfig{
+				TLSConfig:        &tls.Config{RootCAs: pool},
+				HandshakeTimeout: time.Second,
+			})).(*homeAssistantPlatform)
+
+			h.Equals(t, pool, hass.wsOptions.TLSConfig.RootCAs)
+			h.Equals(t, time.Second, hass.wsOptions.HandshakeTimeout)
+		})
+}
+
+func TestNewEndpoint(t *testing.T) {
+	tests := []struct {
+		baseURL   string
+		websocket string
+		api       string
+	}{
+		{"http://192.168.1.5:8123", "ws://192.168.1.5:8123/api/websocket", "http://192.168.1.5:8123/api/states/light.kitchen"},
+		{"https://example.com:8443/hass/", "wss://example.com:8443/hass/api/websocket", "https://example.com:8443/hass/api/states/light.kitchen"},
+		{"wss://example.com", "wss://example.com/api/websocket", "https://example.com/api/states/light.kitchen"},
+	}
+	for _, test := range tests {
+		endpoint, err := newEndpoint(test.baseURL)
+		h.Ok(t, err)
+		h.Equals(t, test.websocket, endpoint.websocketURL())
+		h.Equals(t, test.api, endpoint.apiURL("states/light.kitchen", nil))
+	}
+
+	_, err := newEndpoint("192.168.1.5:8123")
+	h.NotEquals(t, nil, err)
+	_, err = newEndpoint("ftp://example.com")
+	h.NotEquals(t, nil, err)
+
+	endpoint := legacyEndpoint("hassio", false)
+	h.Equals(t, "ws://hassio/homeassistant/websocket", endpoint.websocketURL())
+	h.Equals(t, "http://hassio/homeassistant/api/states/light.kitchen", endpoint.apiURL("states/light.kitchen", nil))
+
+	// Escaped paths are not escaped again
+	endpoint, _ = newEndpoint("http://192.168.1.5:8123")
+	h.Equals(t, "http://192.168.1.5:8123/api/states/sensor.a%2Fb%20c?filter=1",
+		endpoint.apiURL("states/"+url.PathEscape("sensor.a/b c"), url.Values{"filter": {"1"}}))
+}
+
+func TestRestEscapedPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Equals(t, "/api/states/sensor.a%2Fb%20c", r.URL.EscapedPath())
+		fmt.Fprint(w, `{"entity_id": "sensor.a/b c", "state": "on"}`)
+	}))
+	defer server.Close()
+
+	rest, err := NewRestClient(server.URL, "anytoken", ConnectionConfig{})
+	h.Ok(t, err)
+	entity, err := rest.State(context.Background(), "sensor.a/b c")
+	h.Ok(t, err)
+	h.Equals(t, "on", entity.New.State)
+}
+
+func TestStartAddon(t *testing.T) {
+	oldGetenv := getenv
+	oldGetConnected := getConnected
+	defer func() {
+		getenv = oldGetenv
+		getConnected = oldGetConnected
+	}()
+
+	connectedURL := make(chan string, 1)
+	getConnected = func(url string, options ws.Options) ws.Connected {
+		connectedURL <- url
+		return newFakeConnected()
+	}
+
+	t.Run("NotAddon",
+		func(*testing.T) {
+			getenv = func(string) string { return "" }
+			h.Equals(t, false, InAddon())
+			h.Equals(t, false, newHassClient().StartAddon())
+		})
+
+	t.Run("Addon",
+		func(*testing.T) {
+			getenv = func(key string) string {
+				if key == "SUPERVISOR_TOKEN" {
+					return "supervisortoken"
+				}
+				return ""
+			}
+			h.Equals(t, true, InAddon())
+
+			hass := newHassClient()
+			hass.poster = newFakePoster()
+			go hass.StartURL("", "")
+			defer hass.Stop()
+
+			h.Equals(t, "ws://supervisor/core/websocket", <-connectedURL)
+			h.Equals(t, "supervisortoken", hass.token)
+			h.Equals(t, "http://supervisor/core/api/states/light.kitchen",
+				supervisorEndpoint().apiURL("states/light.kitchen", nil))
+		})
+}
+
+func TestSetEntity(t *testing.T) {
+	created := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data SetStateData
+		json.NewDecoder(r.Body).Decode(&data)
+		if data.State == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message": "No state specified."}`)
+			return
+		}
+		if !created {
+			created = true
+			w.WriteHeader(http.StatusCreated)
+		}
+		fmt.Fprintf(w, `{"entity_id": "sensor.test", "state": "%s", "last_updated": "2019-02-16T18:11:44.183673+00:00"}`, data.State)
+	}))
+	defer server.Close()
+
+	hass := NewHassClient(WithLocalEntityUpdate()).(*homeAssistantPlatform)
+	hass.poster = hass
+	hass.endpoint, _ = newEndpoint(server.URL)
+
+	result, err := hass.SetEntity(&HassEntity{ID: "sensor.test", New: HassEntityState{State: "1"}})
+	h.Ok(t, err)
+	h.Equals(t, true, result.Created)
+	h.Equals(t, "1", result.Entity.New.State)
+	h.Equals(t, 2019, result.Entity.New.LastUpdated.Year())
+
+	result, err = hass.SetEntity(&HassEntity{ID: "sensor.test", New: HassEntityState{State: "2"}})
+	h.Ok(t, err)
+	h.Equals(t, false, result.Created)
+	h.Equals(t, "1", result.Entity.Old.State)
+	entity, ok := hass.GetEntity("sensor.test")
+	h.Equals(t, true, ok)
+	h.Equals(t, "2", entity.New.State)
+
+	_, err = hass.SetEntity(&HassEntity{ID: "sensor.test"})
+	apiErr, ok := err.(*APIError)
+	h.Equals(t, true, ok)
+	h.Equals(t, http.StatusBadRequest, apiErr.StatusCode)
+	h.Equals(t, "No state specified.", apiErr.Message)
+}
+
+func TestOfflineQueue(t *testing.T) {
+	t.Run("HoldUntilReplayed",
+		func(*testing.T) {
+			queue := &offlineQueue{size: 2, holding: true}
+			h.Ok(t, queue.add(QueuedCommand{Service: "first"}))
+			h.Ok(t, queue.add(QueuedCommand{Service: "second"}))
+			commands := queue.take()
+			h.Equals(t, 2, len(commands))
+
+			// Still held while replaying
+			held, err := queue.hold(QueuedCommand{Service: "third"})
+			h.Equals(t, true, held)
+			h.Ok(t, err)
+
+			// The newest command is dropped when putting back
+			dropped := queue.putBack(commands)
+			h.Equals(t, 1, len(dropped))
+			h.Equals(t, "third", dropped[0].Service)
+			h.Equals(t, 2, queue.len())
+
+			h.Equals(t, 2, len(queue.take()))
+			h.Equals(t, 0, len(queue.take()))
+			held, _ = queue.hold(QueuedCommand{Service: "fourth"})
+			h.Equals(t, false, held)
+		})
+
+	t.Run("EntityCopied",
+		func(*testing.T) {
+			hass := newHassClient()
+			WithInMemoryOfflineQueue(10)(hass)
+			entity := &HassEntity{ID: "sensor.queued", New: HassEntityState{State: "on",
+				Attributes: map[string]interface{}{"level": 1}}}
+			_, err := hass.setEntityQueued(entity, QueueOptions{})
+			h.Equals(t, ErrQueued, err)
+
+			entity.New.State = "off"
+			entity.New.Attributes["level"] = 2
+			queued := hass.offlineQueue.take()[0].Entity
+			h.Equals(t, "on", queued.New.State)
+			h.Equals(t, 1, queued.New.Attributes["level"])
+		})
+
+	t.Run("FileStore",
+		func(*testing.T) {
+			dir, err := ioutil.TempDir("", "queue")
+			h.Ok(t, err)
+			defer os.RemoveAll(dir)
+			store := NewFileQueueStore(filepath.Join(dir, "queue.json"))
+
+			hass := newHassClient()
+			WithOfflineQueue(10, store)(hass)
+			_, err = hass.callServiceQueued(context.Background(), "turn_on", map[string]string{"entity_id": "light.hall"}, QueueOptions{})
+			h.Equals(t, ErrQueued, err)
+
+			// A new process sends the commands of the last one
+			restarted := newHassClient()
+			WithOfflineQueue(10, store)(restarted)
+			commands := restarted.offlineQueue.take()
+			h.Equals(t, 1, len(commands))
+			h.Equals(t, "light.hall", commands[0].ServiceData["entity_id"])
+
+			// Kept until sent
+			stored, err := store.Load()
+			h.Ok(t, err)
+			h.Equals(t, 1, len(stored))
+			restarted.offlineQueue.sent()
+			stored, err = store.Load()
+			h.Ok(t, err)
+			h.Equals(t, 0, len(stored))
+		})
+
+	t.Run("ContextDeadline",
+		func(*testing.T) {
+			hass := newHassClient()
+			WithInMemoryOfflineQueue(10)(hass)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_, err := hass.CallServiceContext(ctx, "turn_on", nil)
+			h.Equals(t, ErrQueued, err)
+			command := hass.offlineQueue.take()[0]
+			h.Equals(t, true, command.TTL > 0 && command.TTL <= time.Minute)
+		})
+}
+
+func TestVirtualEntities(t *testing.T) {
+	var posts, deletes int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			atomic.AddInt64(&deletes, 1)
+			return
+		}
+		atomic.AddInt64(&posts, 1)
+		var data SetStateData
+		json.NewDecoder(r.Body).Decode(&data)
+		json.NewEncoder(w).Encode(StateData{EntityId: strings.TrimPrefix(r.URL.Path, "/api/states/"), State: data.State})
+	}))
+	defer server.Close()
+
+	hass := NewHassClient(WithRemoveVirtualEntitiesOnStop()).(*homeAssistantPlatform)
+	hass.poster = hass
+	hass.endpoint, _ = newEndpoint(server.URL)
+	virtual := hass.VirtualEntities()
+
+	_, err := virtual.Set("sensor.virtual", "on", nil)
+	h.Equals(t, ErrPublishOnConnect, err)
+	h.Equals(t, int64(0), atomic.LoadInt64(&posts))
+
+	atomic.StoreInt32(&hass.ready, 1)
+	virtual.publishAll()
+	h.Equals(t, int64(1), atomic.LoadInt64(&posts))
+
+	result, err := virtual.Set("sensor.virtual", "off", nil)
+	h.Ok(t, err)
+	h.Equals(t, "off", result.Entity.New.State)
+	h.Equals(t, int64(2), atomic.LoadInt64(&posts))
+
+	hass.handleMessage(Result{MessageType: "event", Event: json.RawMessage(`{"event_type":"homeassistant_started","data":{}}`)})
+	h.Equals(t, int64(3), atomic.LoadInt64(&posts))
+
+	// Someone else changed the state, publish again
+	virtual.changed("sensor.virtual", HassEntityState{State: "on"})
+	virtual.changed("sensor.virtual", HassEntityState{State: "off"})
+	for i := 0; i < 100 && atomic.LoadInt64(&posts) < 4; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	h.Equals(t, int64(4), atomic.LoadInt64(&posts))
+
+	// Attributes are compared too, numbers from Home Assistant are float64
+	_, err = virtual.Set("sensor.virtual", "off", map[string]interface{}{"level": 1})
+	h.Ok(t, err)
+	h.Equals(t, int64(5), atomic.LoadInt64(&posts))
+	virtual.changed("sensor.virtual", HassEntityState{State: "off", Attributes: map[string]interface{}{"level": float64(1)}})
+	hass.entitiesSynced = true
+	hass.handleCompressedEvent(Result{MessageType: "event", Event: json.RawMessage(
+		`{"a": {"sensor.virtual": {"s": "off", "a": {"level": 2}, "lc": 1680697892.5}}}`)})
+	for i := 0; i < 100 && atomic.LoadInt64(&posts) < 6; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	h.Equals(t, int64(6), atomic.LoadInt64(&posts))
+
+	hass.Stop()
+	h.Equals(t, int64(1), atomic.LoadInt64(&deletes))
+}
+
+func TestRestHistory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Equals(t, "/api/history/period/2019-02-16T18:00:00Z", r.URL.Path)
+		h.Equals(t, "light.kitchen", r.URL.Query().Get("filter_entity_id"))
+		_, minimal := r.URL.Query()["minimal_response"]
+		h.Equals(t, true, minimal)
+		fmt.Fprint(w, `[[
+			{"entity_id": "light.kitchen", "state": "on", "attributes": {"friendly_name": "Kitchen"},
+			 "last_changed": "2019-02-16T18:11:44.183673+00:00", "last_updated": "2019-02-16T18:11:44.183673+00:00"},
+			{"state": "off", "last_changed": "2019-02-16T19:11:44+00:00"}
+		]]`)
+	}))
+	defer server.Close()
+
+	rest, err := NewRestClient(server.URL, "token", ConnectionConfig{})
+	h.Ok(t, err)
+	start := time.Date(2019, 2, 16, 18, 0, 0, 0, time.UTC)
+	history, err := rest.History(context.Background(), []string{"light.kitchen"}, start, time.Time{},
+		HistoryOptions{MinimalResponse: true})
+	h.Ok(t, err)
+	states := history["light.kitchen"]
+	h.Equals(t, 2, len(states))
+	h.Equals(t, "Kitchen", states[0].Attributes["friendly_name"])
+	h.Equals(t, "off", states[1].State)
+	h.Equals(t, 19, states[1].LastUpdated.Hour())
+}
+
+func TestRestLogbook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Equals(t, "/api/logbook/2019-02-16T18:00:00Z", r.URL.Path)
+		h.Equals(t, "light.kitchen,light.hall", r.URL.Query().Get("entity"))
+		fmt.Fprint(w, `[{"when": "2019-02-16T18:11:44.183673+00:00", "name": "Kitchen", "message": "turned on",
+			"domain": "light", "entity_id": "light.kitchen", "state": "on",
+			"context_user_id": "31ddb597e03147118cf8d2f8fbea5553"}]`)
+	}))
+	defer server.Close()
+
+	rest, err := NewRestClient(server.URL, "token", ConnectionConfig{})
+	h.Ok(t, err)
+	start := time.Date(2019, 2, 16, 18, 0, 0, 0, time.UTC)
+	entries, err := rest.Logbook(context.Background(), start, time.Time{}, []string{"light.kitchen", "light.hall"})
+	h.Ok(t, err)
+	h.Equals(t, 1, len(entries))
+	h.Equals(t, "light.kitchen", entries[0].EntityID)
+	h.Equals(t, "31ddb597e03147118cf8d2f8fbea5553", entries[0].ContextUserID)
+	h.Equals(t, 11, entries[0].When.Minute())
+}
+
+func TestValidateStatisticsImport(t *testing.T) {
+	value := 1.0
+	start := time.Date(2019, 2, 16, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		metadata   StatisticMetadata
+		statistics []Statistic
+		valid      bool
+	}{
+		{"External", StatisticMetadata{StatisticID: "my_meter:energy", Source: "my_meter", HasSum: true},
+			[]Statistic{{Start: start, Sum: &value}}, true},
+		{"Recorder", StatisticMetadata{StatisticID: "sensor.energy", Source: "recorder", HasMean: true},
+			[]Statistic{{Start: start, Mean: &value}}, true},
+		{"WrongSource", StatisticMetadata{StatisticID: "other:energy", Source: "my_meter", HasSum: true},
+			[]Statistic{{Start: start, Sum: &value}}, false},
+		{"EntityIDExternal", StatisticMetadata{StatisticID: "sensor.energy", Source: "my_meter", HasSum: true},
+			[]Statistic{{Start: start, Sum: &value}}, false},
+		{"UpperCase", StatisticMetadata{StatisticID: "sensor.Energy", Source: "recorder", HasSum: true},
+			[]Statistic{{Start: start, Sum: &value}}, false},
+		{"DoubleUnderscore", StatisticMetadata{StatisticID: "my_meter:energy__total", Source: "my_meter", HasSum: true},
+			[]Statistic{{Start: start, Sum: &value}}, false},
+		{"NoSource", StatisticMetadata{StatisticID: "my_meter:energy", HasSum: true},
+			[]Statistic{{Start: start, Sum: &value}}, false},
+		{"NotTopOfHour", StatisticMetadata{StatisticID: "my_meter:energy", Source: "my_meter", HasSum: true},
+			[]Statistic{{Start: start.Add(time.Minute), Sum: &value}}, false},
+		{"SumWithoutHasSum", StatisticMetadata{StatisticID: "my_meter:energy", Source: "my_meter", HasMean: true},
+			[]Statistic{{Start: start, Sum: &value}}, false},
+		{"NoStatistics", StatisticMetadata{StatisticID: "my_meter:energy", Source: "my_meter", HasSum: true},
+			nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name,
+			func(*testing.T) {
+				err := validateStatisticsImport(test.metadata, test.statistics)
+				h.Equals(t, test.valid, err == nil)
+			})
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	hass := NewHassClient(WithCompression()).(*homeAssistantPlatform)
+	h.Equals(t, true, hass.wsOptions.EnableCompression)
+
+	hass.wsOptions.Stats.MessageBytesRead = 1000
+	hass.wsOptions.Stats.WireBytesRead = 250
+	stats := hass.CompressionStats()
+	h.Equals(t, int64(1000), stats.RawBytesRead)
+	h.Equals(t, 0.25, stats.Ratio())
+}
+
 func TestIntegrations(t *testing.T) {
 	if !*h.IntegrationFlag {
 		t.Skip()
@@ -102,14 +834,14 @@ func TestIntegrations(t *testing.T) {
 
 	t.Run("HttpPost",
 		func(*testing.T) {
-			b := hass.HassHTTPPostAPI("http://127.0.0.1:4002", []byte("Hello world"))
-			h.Equals(t, true, b)
+			_, _, err := hass.HassHTTPPostAPI("http://127.0.0.1:4002", []byte("Hello world"))
+			h.Ok(t, err)
 		})
 
 	t.Run("HttpPostFail",
 		func(*testing.T) {
-			b := hass.HassHTTPPostAPI("http://127.0.0.1:4003", []byte("Hello world"))
-			h.NotEquals(t, true, b)
+			_, _, err := hass.HassHTTPPostAPI("http://127.0.0.1:4003", []byte("Hello world"))
+			h.NotEquals(t, nil, err)
 		})
 }
 
@@ -147,7 +879,7 @@ func serveWS(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "POST done")
 }
 
-func fakeConnectWS(host, path string, ssl bool) ws.Connected {
+func fakeConnectWS(url string, options ws.Options) ws.Connected {
 	connSuccess := connectSuccess.Load().(bool)
 	if connSuccess {
 		return newFakeConnected()
@@ -163,17 +895,21 @@ func newFakeConnected() *fakeConnected {
 
 type fakeConnected struct {
 	doNothingChannel chan bool
+	closeOnce        sync.Once
 }
 
 func (a *fakeConnected) Close() {
-	close(a.doNothingChannel)
+	a.closeOnce.Do(func() { close(a.doNothingChannel) })
 }
-func (a *fakeConnected) SendMap(message map[string]interface{}) {
+func (a *fakeConnected) SendMap(ctx context.Context, message map[string]interface{}) error {
 	panic("Not implemented")
 }
-func (a *fakeConnected) SendString(message string) {
+func (a *fakeConnected) SendString(ctx context.Context, message string) error {
 	panic("Not implemented")
 }
+func (a *fakeConnected) QueueDepth() int {
+	return 0
+}
 func (a *fakeConnected) Read() ([]byte, bool) {
 	<-a.doNothingChannel
 	return nil, false
@@ -189,6 +925,6 @@ func newFakePoster() *fakeHassAPIPoster {
 type fakeHassAPIPoster struct {
 }
 
-func (a *fakeHassAPIPoster) HassHTTPPostAPI(url string, data []byte) bool {
+func (a *fakeHassAPIPoster) HassHTTPPostAPI(url string, data []byte) (int, []byte, error) {
 	panic("Not implemented")
 }
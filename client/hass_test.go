@@ -1,8 +1,12 @@
 package client_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -11,6 +15,7 @@ import (
 
 	c "github.com/helto4real/go-hassclient/client"
 	h "github.com/helto4real/go-hassclient/internal/test"
+	"github.com/helto4real/go-hassclient/transport"
 )
 
 // var h.IntegrationFlag *bool = flag.Bool("h.IntegrationFlag", false, "run h.IntegrationFlag tests")
@@ -29,6 +34,7 @@ func TestIntegrationWebSocket(t *testing.T) {
 			}
 			switch v := message.(type) {
 			case c.HassCallServiceEvent:
+				fake.lastCallServiceEvent.Store(v)
 				atomic.AddInt64(&fake.nrOfEvents, 1)
 			case c.HassEntity:
 				atomic.AddInt64(&fake.nrOfEntities, 1)
@@ -62,8 +68,8 @@ func TestIntegrationWebSocket(t *testing.T) {
 
 	t.Run("SetEntity",
 		func(*testing.T) {
-			ok := hass.SetEntity(&c.HassEntity{})
-			h.Equals(t, true, ok)
+			_, err := hass.SetEntity(&c.HassEntity{})
+			h.Ok(t, err)
 			h.Equals(t, 1, fakePoster.nrOfPostCalls)
 			h.Equals(t, false, strings.Contains(fakePoster.url,
 				"/homeassistant/api/states/"))
@@ -73,6 +79,92 @@ func TestIntegrationWebSocket(t *testing.T) {
 				"https"))
 		})
 
+	t.Run("History",
+		func(*testing.T) {
+			history, err := hass.Recorder().History(context.Background(), []string{"light.kitchen", "sensor.temperature"},
+				time.Now().Add(-time.Hour), time.Time{}, c.HistoryOptions{MinimalResponse: true})
+			h.Ok(t, err)
+			h.Equals(t, 2, len(history["light.kitchen"]))
+			h.Equals(t, "on", history["light.kitchen"][0].State)
+			h.Equals(t, "Kitchen", history["light.kitchen"][0].Attributes["friendly_name"])
+			h.Equals(t, "off", history["light.kitchen"][1].State)
+			h.Equals(t, history["light.kitchen"][1].LastUpdated, history["light.kitchen"][1].LastChanged)
+			h.Equals(t, "21.5", history["sensor.temperature"][0].State)
+		})
+
+	t.Run("StreamHistory",
+		func(*testing.T) {
+			events := make(chan c.HistoryStreamEvent, 2)
+			subscription, err := hass.Recorder().StreamHistory(context.Background(), []string{"light.kitchen"},
+				time.Unix(1550337104, 0), time.Time{}, c.HistoryOptions{}, func(event c.HistoryStreamEvent) {
+					events <- event
+				})
+			h.Ok(t, err)
+
+			backfill := <-events
+			h.Equals(t, "on", backfill.States["light.kitchen"][0].State)
+			h.Equals(t, int64(1550337104), backfill.StartTime.Unix())
+
+			fake.SimulateHistoryStreamEvent()
+			live := <-events
+			h.Equals(t, "off", live.States["light.kitchen"][0].State)
+
+			h.Ok(t, subscription.Unsubscribe(context.Background()))
+			<-subscription.Done()
+		})
+
+	t.Run("StreamLogbook",
+		func(*testing.T) {
+			events := make(chan c.LogbookStreamEvent, 1)
+			subscription, err := hass.Recorder().StreamLogbook(context.Background(), time.Unix(1550337104, 0), time.Time{},
+				[]string{"light.kitchen"}, func(event c.LogbookStreamEvent) {
+					events <- event
+				})
+			h.Ok(t, err)
+
+			event := <-events
+			h.Equals(t, 1, len(event.Entries))
+			h.Equals(t, "turned on", event.Entries[0].Message)
+			h.Equals(t, "31ddb597e03147118cf8d2f8fbea5553", event.Entries[0].ContextUserID)
+			h.Equals(t, int64(1550340704), event.Entries[0].When.Unix())
+			h.Ok(t, subscription.Unsubscribe(context.Background()))
+		})
+
+	t.Run("Statistics",
+		func(*testing.T) {
+			metadata, err := hass.Recorder().ListStatisticIDs(context.Background(), c.StatisticTypeSum)
+			h.Ok(t, err)
+			h.Equals(t, "kWh", metadata[0].UnitOfMeasurement)
+			h.Equals(t, true, metadata[0].HasSum)
+
+			statistics, err := hass.Recorder().Statistics(context.Background(), []string{"sensor.energy"},
+				time.Unix(1550340000, 0), time.Time{}, c.StatisticPeriodHour, []c.StatisticType{c.StatisticTypeSum, c.StatisticTypeState})
+			h.Ok(t, err)
+			series := statistics["sensor.energy"]
+			h.Equals(t, 2, len(series))
+			h.Equals(t, int64(1550343600), series[1].Start.Unix())
+			h.Equals(t, 13.75, *series[1].Sum)
+			h.Equals(t, true, series[1].Mean == nil)
+
+			_, err = hass.Recorder().Statistics(context.Background(), []string{"sensor.energy"},
+				time.Unix(1550340000, 0), time.Time{}, "year", nil)
+			h.NotEquals(t, nil, err)
+		})
+
+	t.Run("ImportStatistics",
+		func(*testing.T) {
+			sum := 12.5
+			err := hass.Recorder().ImportStatistics(context.Background(), c.StatisticMetadata{
+				StatisticID:       "my_meter:energy",
+				Source:            "my_meter",
+				UnitOfMeasurement: "kWh",
+				HasSum:            true,
+			}, []c.Statistic{{Start: time.Unix(1550340000, 0), Sum: &sum}})
+			h.Ok(t, err)
+
+			h.Ok(t, hass.Recorder().AdjustSumStatistics(context.Background(), "my_meter:energy", time.Unix(1550340000, 0), -2.5, "kWh"))
+		})
+
 	t.Run("Test Events",
 		func(*testing.T) {
 			entity, ok := hass.GetEntity("binary_sensor.vardagsrum_pir")
@@ -96,15 +188,49 @@ func TestIntegrationWebSocket(t *testing.T) {
 			h.Equals(t, true, ok)
 		})
 
+	t.Run("Context",
+		func(*testing.T) {
+			entity, ok := hass.GetEntity("binary_sensor.vardagsrum_pir")
+			h.Equals(t, true, ok)
+			h.Equals(t, "849ebede7b294a019c724a07dac43f9c", entity.New.Context.ID)
+			h.Equals(t, false, entity.New.Context.ByUser())
+
+			entity, ok = hass.GetEntity("zone.test")
+			h.Equals(t, true, ok)
+			h.Equals(t, "f48f9a312c68402a81230b9f14a00a23", entity.New.Context.ID)
+
+			event := fake.lastCallServiceEvent.Load().(c.HassCallServiceEvent)
+			h.Equals(t, "LOCAL", event.Origin)
+			h.Equals(t, "2bbb14fc617a4e088b3cbbe37d9fbee8", event.Context.ID)
+			h.Equals(t, "", event.Context.UserID)
+		})
+
+	t.Run("Ping",
+		func(*testing.T) {
+			latency, err := hass.Ping()
+			h.Ok(t, err)
+			h.Equals(t, true, latency > 0)
+			h.Equals(t, latency, hass.Latency())
+		})
+
 	t.Run("CallService",
 		func(*testing.T) {
-			hass.CallService("light/turn_on", map[string]string{"state": "on"})
+			contextID, err := hass.CallService("light/turn_on", map[string]string{"state": "on"})
+			h.Ok(t, err)
+			h.Equals(t, "01GX6KZ5Y8A2QJ3M9R7T4V0W1C", contextID)
 			time.Sleep(time.Second)
 			nrOfCallService := atomic.LoadInt64(&fake.nrOfCallService)
 			h.Equals(t, int64(1), nrOfCallService)
 		})
 }
 
+func TestCallServiceNotConnected(t *testing.T) {
+	hass := c.NewHassClient()
+	_, err := hass.CallService("light/turn_on", map[string]string{"entity_id": "light.kitchen"})
+	h.Equals(t, c.ErrNotConnected, err)
+	h.Equals(t, 0, hass.QueueDepth())
+}
+
 func TestHassEntityString(t *testing.T) {
 	entity := c.NewHassEntity("id1", "name1", c.HassEntityState{
 		State: "Old state"}, c.HassEntityState{
@@ -142,8 +268,8 @@ func TestIntegrationWebSocketSSL(t *testing.T) {
 
 	t.Run("SetEntity",
 		func(*testing.T) {
-			ok := hass.SetEntity(&c.HassEntity{})
-			h.Equals(t, true, ok)
+			_, err := hass.SetEntity(&c.HassEntity{})
+			h.Ok(t, err)
 			h.Equals(t, 1, fakePoster.nrOfPostCalls)
 			h.Equals(t, false, strings.Contains(fakePoster.url,
 				"/homeassistant/api/states/"))
@@ -174,14 +300,546 @@ func TestIntegrationWebSocketHassio(t *testing.T) {
 
 	t.Run("SetEntity",
 		func(*testing.T) {
-			ok := hass.SetEntity(&c.HassEntity{})
-			h.Equals(t, true, ok)
+			_, err := hass.SetEntity(&c.HassEntity{})
+			h.Ok(t, err)
 			h.Equals(t, 1, fakePoster.nrOfPostCalls)
 			h.Equals(t, true, strings.Contains(fakePoster.url,
 				"/homeassistant/api/states/"))
 		})
 }
 
+func TestIntegrationSubscribeEntities(t *testing.T) {
+	fake := newFakeConnected()
+	fakePoster := newFakePoster()
+	hass := c.NewHassClientFakeConnection(fake, fakePoster, c.WithSubscribeEntities())
+
+	go func() {
+		for {
+			message, ok := <-hass.GetHassChannel()
+			if !ok {
+				return
+			}
+			if _, ok := message.(c.HassEntity); ok {
+				atomic.AddInt64(&fake.nrOfEntities, 1)
+			}
+		}
+	}()
+	go hass.Start("fake", false, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+
+	t.Run("Added",
+		func(*testing.T) {
+			entity, ok := hass.GetEntity("light.tomas_rum_fonster")
+			h.Equals(t, true, ok)
+			h.Equals(t, "on", entity.New.State)
+			h.Equals(t, float64(255), entity.New.Attributes["brightness"])
+			h.Equals(t, "01GX6W0CZ3MXNHE6S8R3BR2ZEQ", entity.New.Context.ID)
+			h.Equals(t, int64(1680697892), entity.New.LastChanged.Unix())
+			h.Equals(t, 123456000, entity.New.LastChanged.Nanosecond())
+			h.Equals(t, entity.New.LastChanged, entity.New.LastUpdated)
+
+			entity, ok = hass.GetEntity("binary_sensor.vardagsrum_pir")
+			h.Equals(t, true, ok)
+			h.Equals(t, true, entity.New.Context.ByUser())
+			h.Equals(t, int64(1680697800), entity.New.LastChanged.Unix())
+			h.Equals(t, int64(1680697892), entity.New.LastUpdated.Unix())
+		})
+
+	t.Run("ChangedAndRemoved",
+		func(*testing.T) {
+			fake.SimulateEntitiesChanged()
+			time.Sleep(time.Millisecond * 100)
+
+			entity, ok := hass.GetEntity("light.tomas_rum_fonster")
+			h.Equals(t, true, ok)
+			h.Equals(t, "off", entity.New.State)
+			h.Equals(t, "on", entity.Old.State)
+			_, exists := entity.New.Attributes["brightness"]
+			h.Equals(t, false, exists)
+			h.Equals(t, "Tomas rum fönster", entity.New.Attributes["friendly_name"])
+			h.Equals(t, "01GX6W1ZP9DQ8T7RSR3XN5DKQM", entity.New.Context.ID)
+			h.Equals(t, int64(1680697950), entity.New.LastUpdated.Unix())
+
+			_, ok = hass.GetEntity("sensor.removed")
+			h.Equals(t, false, ok)
+			// 3 added, 1 changed and 1 removed
+			h.Equals(t, int64(5), atomic.LoadInt64(&fake.nrOfEntities))
+		})
+}
+
+func TestIntegrationCoalesceMessages(t *testing.T) {
+	fake := newFakeConnected()
+	fakePoster := newFakePoster()
+	hass := c.NewHassClientFakeConnection(fake, fakePoster, c.WithCoalesceMessages())
+
+	go func() {
+		for {
+			message, ok := <-hass.GetHassChannel()
+			if !ok {
+				return
+			}
+			if _, ok := message.(c.HassCallServiceEvent); ok {
+				atomic.AddInt64(&fake.nrOfEvents, 1)
+			}
+		}
+	}()
+	go hass.Start("fake", false, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+	h.Equals(t, int64(1), atomic.LoadInt64(&fake.nrOfSupportedFeatures))
+
+	fake.SimulateCoalescedEvents()
+	time.Sleep(time.Millisecond * 100)
+
+	entity, ok := hass.GetEntity("binary_sensor.vardagsrum_pir")
+	h.Equals(t, true, ok)
+	h.Equals(t, "off", entity.New.State)
+	h.Equals(t, int64(1), atomic.LoadInt64(&fake.nrOfEvents))
+}
+
+func TestIntegrationCoalescedEntities(t *testing.T) {
+	fake := newFakeConnected()
+	fakePoster := newFakePoster()
+	hass := c.NewHassClientFakeConnection(fake, fakePoster, c.WithCoalesceMessages())
+
+	go func() {
+		for {
+			message, ok := <-hass.GetHassChannel()
+			if !ok {
+				return
+			}
+			switch message.(type) {
+			case c.HassCallServiceEvent:
+				atomic.AddInt64(&fake.nrOfEvents, 1)
+			case c.HassEntity:
+				atomic.AddInt64(&fake.nrOfEntities, 1)
+			}
+		}
+	}()
+	go hass.Start("fake", false, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+
+	fake.SimulateCoalescedEvents()
+	time.Sleep(time.Millisecond * 100)
+
+	// All states and the state change in the coalesced frame
+	h.Equals(t, int64(20), atomic.LoadInt64(&fake.nrOfEntities))
+	h.Equals(t, int64(1), atomic.LoadInt64(&fake.nrOfEvents))
+}
+
+func TestIntegrationTransport(t *testing.T) {
+	clientConn, serverConn := transport.Pipe()
+	var dialedURL string
+	dialer := transport.DialerFunc(func(ctx context.Context, url string) (transport.Conn, error) {
+		dialedURL = url
+		return clientConn, nil
+	})
+	go fakeHassServer(serverConn)
+
+	hass := c.NewHassClient(c.WithTransport(dialer))
+	go func() {
+		for {
+			if _, ok := <-hass.GetHassChannel(); !ok {
+				return
+			}
+		}
+	}()
+	go hass.Start("fake:8123", true, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+	h.Equals(t, "wss://fake:8123/api/websocket", dialedURL)
+
+	entity, ok := hass.GetEntity("group.all_lights")
+	h.Equals(t, true, ok)
+	h.Equals(t, "on", entity.New.State)
+}
+
+func TestIntegrationConnection(t *testing.T) {
+	clientConn, serverConn := transport.Pipe()
+	go fakeHassServer(serverConn)
+
+	hass := c.NewHassClientConnection(clientConn, newFakePoster())
+	go func() {
+		for {
+			if _, ok := <-hass.GetHassChannel(); !ok {
+				return
+			}
+		}
+	}()
+	go hass.Start("fake", false, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+	entity, ok := hass.GetEntity("group.all_lights")
+	h.Equals(t, true, ok)
+	h.Equals(t, "on", entity.New.State)
+}
+
+func TestTransportWithWebsocketOptions(t *testing.T) {
+	dialer := transport.WebsocketDialer(transport.WebsocketOptions{})
+	hass := c.NewHassClient(c.WithTransport(dialer), c.WithCompression())
+	h.Equals(t, false, hass.Start("fake:8123", false, "anytoken"))
+
+	hass = c.NewHassClient(c.WithTransport(dialer), c.WithMaxMessageSize(1024))
+	h.Equals(t, false, hass.Start("fake:8123", false, "anytoken"))
+}
+
+// fakeHassServer answers commands like Home Assistant using the test data
+func fakeHassServer(conn transport.Conn) {
+	ctx := context.Background()
+	resp, _ := ioutil.ReadFile("testdata/auth_required.json")
+	conn.WriteMessage(ctx, resp)
+	for {
+		message, err := conn.ReadMessage(ctx)
+		if err != nil {
+			return
+		}
+		var command map[string]interface{}
+		json.Unmarshal(message, &command)
+		id := fmt.Sprint(command["id"])
+
+		switch command["type"] {
+		case "auth":
+			resp, _ = ioutil.ReadFile("testdata/auth_ok.json")
+		case "get_config":
+			resp, _ = ioutil.ReadFile("testdata/result_config.json")
+		case "get_states":
+			resp, _ = ioutil.ReadFile("testdata/result_states.json")
+		default:
+			resp, _ = ioutil.ReadFile("testdata/result_msg.json")
+		}
+		conn.WriteMessage(ctx, replaceId(resp, "123456789", id))
+	}
+}
+
+func TestIntegrationStartURL(t *testing.T) {
+	fake := newFakeConnected()
+	fakePoster := newFakePoster()
+	hass := c.NewHassClientFakeConnection(fake, fakePoster)
+	go func() {
+		for {
+			if _, ok := <-hass.GetHassChannel(); !ok {
+				return
+			}
+		}
+	}()
+	go hass.StartURL("https://example.com:8443/hass", "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+
+	_, err := hass.SetEntity(&c.HassEntity{ID: "sensor.test"})
+	h.Ok(t, err)
+	h.Equals(t, "https://example.com:8443/hass/api/states/sensor.test", fakePoster.url)
+}
+
+func TestIntegrationOfflineQueue(t *testing.T) {
+	fake := newFakeConnected()
+	fakePoster := newFakePoster()
+	hass := c.NewHassClientFakeConnection(fake, fakePoster, c.WithInMemoryOfflineQueue(10))
+
+	expired := make(chan c.HassCommandExpired, 1)
+	go func() {
+		for {
+			message, ok := <-hass.GetHassChannel()
+			if !ok {
+				return
+			}
+			if command, ok := message.(c.HassCommandExpired); ok {
+				expired <- command
+			}
+		}
+	}()
+
+	// Not started yet so everything is queued
+	_, err := hass.SetEntity(&c.HassEntity{ID: "sensor.queued"})
+	h.Equals(t, c.ErrQueued, err)
+	_, err = hass.CallServiceQueued("light/turn_on", map[string]string{"entity_id": "light.kitchen"},
+		c.QueueOptions{Key: "kitchen"})
+	h.Equals(t, c.ErrQueued, err)
+	_, err = hass.CallServiceQueued("light/turn_on", map[string]string{"entity_id": "light.hall"},
+		c.QueueOptions{TTL: time.Millisecond})
+	h.Equals(t, c.ErrQueued, err)
+	// Replaces the first kitchen command
+	_, err = hass.CallServiceQueued("light/turn_off", map[string]string{"entity_id": "light.kitchen"},
+		c.QueueOptions{Key: "kitchen"})
+	h.Equals(t, c.ErrQueued, err)
+	h.Equals(t, 3, hass.QueuedCommands())
+	time.Sleep(time.Millisecond * 10)
+
+	go hass.Start("fake", false, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+
+	command := <-expired
+	h.Equals(t, "light.hall", command.Command.ServiceData["entity_id"])
+
+	for i := 0; i < 100 && atomic.LoadInt64(&fake.nrOfCallService) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	h.Equals(t, int64(1), atomic.LoadInt64(&fake.nrOfCallService))
+	h.Equals(t, 1, fakePoster.nrOfPostCalls)
+	h.Equals(t, "http://fake/api/states/sensor.queued", fakePoster.url)
+	h.Equals(t, 0, hass.QueuedCommands())
+}
+
+func TestRestClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hass/api/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer anytoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "401: Unauthorized")
+			return
+		}
+		fmt.Fprint(w, `{"message": "API running."}`)
+	})
+	mux.HandleFunc("/hass/api/states", func(w http.ResponseWriter, r *http.Request) {
+		var result struct {
+			Result json.RawMessage `json:"result"`
+		}
+		content, _ := ioutil.ReadFile("testdata/result_states.json")
+		json.Unmarshal(content, &result)
+		w.Write(result.Result)
+	})
+	mux.HandleFunc("/hass/api/states/sensor.missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Entity not found."}`)
+	})
+	mux.HandleFunc("/hass/api/services/light/turn_on", func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		fmt.Fprintf(w, `[{"entity_id": "%s", "state": "on", "last_updated": "2019-02-16T18:11:44.183673+00:00"}]`,
+			data["entity_id"])
+	})
+	mux.HandleFunc("/hass/api/template", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "above_horizon")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	rest, err := c.NewRestClient(server.URL+"/hass", "anytoken", c.ConnectionConfig{})
+	h.Ok(t, err)
+	ctx := context.Background()
+
+	status, err := rest.Status(ctx)
+	h.Ok(t, err)
+	h.Equals(t, "API running.", status)
+
+	states, err := rest.States(ctx)
+	h.Ok(t, err)
+	h.Equals(t, "zone.test", states[0].ID)
+	h.Equals(t, "zoning", states[0].New.State)
+
+	_, err = rest.State(ctx, "sensor.missing")
+	apiErr, ok := err.(*c.APIError)
+	h.Equals(t, true, ok)
+	h.Equals(t, http.StatusNotFound, apiErr.StatusCode)
+	h.Equals(t, "Entity not found.", apiErr.Message)
+
+	changed, err := rest.CallService(ctx, "light", "turn_on", map[string]interface{}{"entity_id": "light.kitchen"})
+	h.Ok(t, err)
+	h.Equals(t, 1, len(changed))
+	h.Equals(t, "light.kitchen", changed[0].ID)
+
+	rendered, err := rest.RenderTemplate(ctx, "{{ states('sun.sun') }}")
+	h.Ok(t, err)
+	h.Equals(t, "above_horizon", rendered)
+
+	unauthorized, err := c.NewRestClient(server.URL+"/hass", "badtoken", c.ConnectionConfig{})
+	h.Ok(t, err)
+	_, err = unauthorized.Status(ctx)
+	h.Equals(t, "home assistant api: 401 401: Unauthorized", err.Error())
+}
+
+func TestIntegrationRegistryCache(t *testing.T) {
+	fake := newFakeConnected()
+	fakePoster := newFakePoster()
+	hass := c.NewHassClientFakeConnection(fake, fakePoster, c.WithRegistryCache())
+	turnedOff := make(chan c.HassEntity, 1)
+	go func() {
+		for {
+			message, ok := <-hass.GetHassChannel()
+			if !ok {
+				return
+			}
+			if entity, ok := message.(c.HassEntity); ok && entity.ID == "light.tvrummet_vanster" && entity.New.State == "off" {
+				turnedOff <- entity
+			}
+		}
+	}()
+	go hass.Start("fake", false, "anytoken")
+	defer hass.Stop()
+
+	state := <-hass.GetStatusChannel()
+	h.Equals(t, true, state)
+	// The registries are loaded after ready
+	waitFor(func() bool { _, ok := hass.Registry().GetEntry("light.tvrummet_vanster"); return ok })
+
+	t.Run("Areas",
+		func(*testing.T) {
+			h.Equals(t, 2, len(hass.Registry().Areas()))
+			area, ok := hass.Registry().FindArea("cookhouse")
+			h.Equals(t, true, ok)
+			h.Equals(t, "kitchen", area.ID)
+
+			area, err := hass.Registry().CreateArea(context.Background(), c.Area{Name: "Garage", Icon: "mdi:garage"})
+			h.Ok(t, err)
+			h.Equals(t, "garage", area.ID)
+			cached, ok := hass.Registry().GetArea("garage")
+			h.Equals(t, true, ok)
+			h.Equals(t, "mdi:garage", cached.Icon)
+			_, hasPicture := fake.areaMessage["picture"]
+			h.Equals(t, false, hasPicture)
+
+			name := "Car port"
+			_, err = hass.Registry().UpdateArea(context.Background(), "garage", c.AreaUpdate{Name: &name})
+			h.Ok(t, err)
+			_, hasIcon := fake.areaMessage["icon"]
+			h.Equals(t, false, hasIcon)
+			cached, _ = hass.Registry().GetArea("garage")
+			h.Equals(t, "Car port", cached.Name)
+
+			h.Ok(t, hass.Registry().DeleteArea(context.Background(), "garage"))
+			_, ok = hass.Registry().GetArea("garage")
+			h.Equals(t, false, ok)
+		})
+
+	t.Run("Devices",
+		func(*testing.T) {
+			devices := hass.Registry().Devices()
+			h.Equals(t, 2, len(devices))
+			h.Equals(t, "Hue bridge", devices[0].DisplayName())
+			h.Equals(t, "Tv lamp", devices[1].DisplayName())
+			h.Equals(t, []string{"hue", "00:17:88:01:00:bd:c7:b9-0b"}, devices[1].Identifiers[0])
+
+			entity, ok := hass.GetEntity("light.tvrummet_vanster")
+			h.Equals(t, true, ok)
+			device, ok := hass.Registry().EntityDevice(entity)
+			h.Equals(t, true, ok)
+			h.Equals(t, "Signify Netherlands B.V.", device.Manufacturer)
+			h.Equals(t, "e1f9b7a9c8d7e6f5a4b3c2d1e0f9a8b7", device.ViaDeviceID)
+
+			area := "kitchen"
+			device, err := hass.Registry().UpdateDevice(context.Background(), "e1f9b7a9c8d7e6f5a4b3c2d1e0f9a8b7", c.DeviceUpdate{AreaID: &area})
+			h.Ok(t, err)
+			h.Equals(t, "kitchen", device.AreaID)
+			cached, _ := hass.Registry().GetDevice("e1f9b7a9c8d7e6f5a4b3c2d1e0f9a8b7")
+			h.Equals(t, "kitchen", cached.AreaID)
+		})
+
+	t.Run("EntityRegistry",
+		func(*testing.T) {
+			entity, ok := hass.GetEntity("light.tvrummet_vanster")
+			h.Equals(t, true, ok)
+			h.Equals(t, "hue", entity.Registry.Platform)
+			h.Equals(t, "00:17:88:01:00:bd:c7:b9-0b", entity.Registry.UniqueID)
+
+			// The area of the device
+			area, ok := hass.Registry().EntityArea("light.tvrummet_vanster")
+			h.Equals(t, true, ok)
+			h.Equals(t, "living_room", area.ID)
+			lights := hass.Registry().EntitiesInArea("living_room", "light")
+			h.Equals(t, 1, len(lights))
+			h.Equals(t, "light.tvrummet_vanster", lights[0].ID)
+
+			// The area of the entity itself
+			sensors := hass.Registry().EntitiesInArea("kitchen", "sensor")
+			h.Equals(t, 1, len(sensors))
+			h.Equals(t, "diagnostic", sensors[0].Registry.EntityCategory)
+
+			name := "Mode"
+			newEntityID := "sensor.mode"
+			entry, err := hass.Registry().UpdateEntry(context.Background(), "sensor.house_mode",
+				c.EntityUpdate{Name: &name, NewEntityID: &newEntityID})
+			h.Ok(t, err)
+			h.Equals(t, "sensor.mode", entry.EntityID)
+			_, ok = hass.Registry().GetEntry("sensor.house_mode")
+			h.Equals(t, false, ok)
+			cached, ok := hass.Registry().GetEntry("sensor.mode")
+			h.Equals(t, true, ok)
+			h.Equals(t, "Mode", cached.Name)
+
+			h.Ok(t, hass.Registry().RemoveEntry(context.Background(), "sensor.mode"))
+			_, ok = hass.Registry().GetEntry("sensor.mode")
+			h.Equals(t, false, ok)
+		})
+
+	t.Run("RegistrySnapshot",
+		func(*testing.T) {
+			fake.eventChannel <- []byte(`{"id": 1, "type": "event", "event": {"event_type": "state_changed", "data": {
+				"entity_id": "light.tvrummet_vanster", "old_state": null, "new_state": {"entity_id": "light.tvrummet_vanster",
+				"state": "off", "attributes": {}, "last_changed": "2019-02-17T11:41:08.015070+00:00",
+				"last_updated": "2019-02-17T11:41:08.015070+00:00"}}, "origin": "LOCAL", "time_fired": "2019-02-17T11:41:08.015070+00:00"}}`)
+			entity := <-turnedOff
+			h.Equals(t, "hue", entity.Registry.Platform)
+
+			before, _ := hass.GetEntity("light.tvrummet_vanster")
+			fake.SimulateRegistryUpdated("entity_registry_updated", `{"action": "update", "entity_id": "light.tvrummet_vanster"}`)
+			waitFor(func() bool {
+				after, _ := hass.GetEntity("light.tvrummet_vanster")
+				return after.Registry.AreaID == "garage"
+			})
+			after, _ := hass.GetEntity("light.tvrummet_vanster")
+			h.Equals(t, "garage", after.Registry.AreaID)
+			h.Equals(t, "", before.Registry.AreaID)
+		})
+
+	t.Run("AreaRegistryUpdated",
+		func(*testing.T) {
+			// Both changes are listed once
+			fake.SimulateRegistryUpdated("area_registry_updated", `{"action": "create", "area_id": "garage"}`)
+			fake.SimulateRegistryUpdated("area_registry_updated", `{"action": "update", "area_id": "garage"}`)
+			for i := 0; i < 100 && atomic.LoadInt64(&fake.nrOfAreaLists) < 2; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			time.Sleep(time.Millisecond * 700)
+			h.Equals(t, int64(2), atomic.LoadInt64(&fake.nrOfAreaLists))
+
+			fake.SimulateRegistryUpdated("area_registry_updated", `{"action": "remove", "area_id": "kitchen"}`)
+			waitFor(func() bool { _, ok := hass.Registry().GetArea("kitchen"); return !ok })
+			_, ok := hass.Registry().GetArea("kitchen")
+			h.Equals(t, false, ok)
+		})
+
+	t.Run("EntityRegistryUpdated",
+		func(*testing.T) {
+			fake.SimulateRegistryUpdated("entity_registry_updated",
+				`{"action": "update", "entity_id": "light.tv", "old_entity_id": "light.tvrummet_vanster"}`)
+			waitFor(func() bool { _, ok := hass.Registry().GetEntry("light.tv"); return ok })
+			entry, ok := hass.Registry().GetEntry("light.tv")
+			h.Equals(t, true, ok)
+			h.Equals(t, "garage", entry.AreaID)
+			_, ok = hass.Registry().GetEntry("light.tvrummet_vanster")
+			h.Equals(t, false, ok)
+
+			fake.SimulateRegistryUpdated("entity_registry_updated", `{"action": "remove", "entity_id": "light.tv"}`)
+			waitFor(func() bool { _, ok := hass.Registry().GetEntry("light.tv"); return !ok })
+			_, ok = hass.Registry().GetEntry("light.tv")
+			h.Equals(t, false, ok)
+		})
+}
+
+// waitFor polls the condition for at most a second
+func waitFor(condition func() bool) {
+	for i := 0; i < 100 && !condition(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
 func newFakeConnected() *fakeConnected {
 
 	fake := fakeConnected{
@@ -203,16 +861,29 @@ type fakeConnected struct {
 	nrOfEntities    int64
 	nrOfEvents      int64
 	nrOfCallService int64
+
+	lastCallServiceEvent atomic.Value
+	subscribeEntitiesID  string
+	historyStreamID      string
+	nrOfAreaLists        int64
+	areaMessage          map[string]interface{}
+
+	nrOfSupportedFeatures int64
 }
 
 func (a *fakeConnected) Close() {
 
 }
-func (a *fakeConnected) SendMap(message map[string]interface{}) {
+func (a *fakeConnected) SendMap(ctx context.Context, message map[string]interface{}) error {
 	a.mapChannel <- message
+	return nil
 }
-func (a *fakeConnected) SendString(message string) {
+func (a *fakeConnected) SendString(ctx context.Context, message string) error {
 	a.stringChannel <- message
+	return nil
+}
+func (a *fakeConnected) QueueDepth() int {
+	return 0
 }
 func (a *fakeConnected) Read() ([]byte, bool) {
 
@@ -237,23 +908,9 @@ func (a *fakeConnected) Read() ([]byte, bool) {
 			return nil, false
 		}
 		msgType, _ := sendMap["type"].(string)
-		if msgType == "get_config" {
-			resp, _ := ioutil.ReadFile("testdata/result_config.json")
-			id := strconv.FormatInt(sendMap["id"].(int64), 10)
-			return replaceId(resp, "123456789", id), true
-		} else if msgType == "get_states" {
-			resp, _ := ioutil.ReadFile("testdata/result_states.json")
-			id := strconv.FormatInt(sendMap["id"].(int64), 10)
-			return replaceId(resp, "123456789", id), true
-		} else if msgType == "subscribe_events" {
-			resp, _ := ioutil.ReadFile("testdata/result_msg.json")
-			id := strconv.FormatInt(sendMap["id"].(int64), 10)
-			return replaceId(resp, "123456789", id), true
-		} else if msgType == "call_service" {
-			resp, _ := ioutil.ReadFile("testdata/result_msg.json")
+		if response, ok := fakeResponses[msgType]; ok {
 			id := strconv.FormatInt(sendMap["id"].(int64), 10)
-			atomic.AddInt64(&a.nrOfCallService, 1)
-			return replaceId(resp, "123456789", id), true
+			return response(a, sendMap, id), true
 		}
 
 	case event, ok := <-a.eventChannel:
@@ -265,6 +922,116 @@ func (a *fakeConnected) Read() ([]byte, bool) {
 
 	panic("Unknown input")
 }
+
+// fakeResponse returns the response to a command sent to the fake
+type fakeResponse func(a *fakeConnected, message map[string]interface{}, id string) []byte
+
+// fakeResponses has the response for each message type
+var fakeResponses = map[string]fakeResponse{
+	"get_config":                     fakeFile("testdata/result_config.json"),
+	"get_states":                     fakeFile("testdata/result_states.json"),
+	"subscribe_events":               fakeFile("testdata/result_msg.json"),
+	"unsubscribe_events":             fakeFile("testdata/result_msg.json"),
+	"recorder/import_statistics":     fakeFile("testdata/result_msg.json"),
+	"recorder/adjust_sum_statistics": fakeFile("testdata/result_msg.json"),
+	"config/area_registry/delete":    fakeFile("testdata/result_msg.json"),
+	"config/entity_registry/remove":  fakeFile("testdata/result_msg.json"),
+	"config/device_registry/list":    fakeFile("testdata/device_registry.json"),
+	"config/entity_registry/list":    fakeFile("testdata/entity_registry.json"),
+	"history/history_during_period":  fakeFile("testdata/result_history.json"),
+	"ping": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		return []byte(`{"id": ` + id + `, "type": "pong"}`)
+	},
+	"supported_features": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		atomic.AddInt64(&a.nrOfSupportedFeatures, 1)
+		return fakeFile("testdata/result_msg.json")(a, message, id)
+	},
+	"call_service": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		atomic.AddInt64(&a.nrOfCallService, 1)
+		return fakeFile("testdata/result_call_service.json")(a, message, id)
+	},
+	"subscribe_entities": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		a.subscribeEntitiesID = id
+		event, _ := ioutil.ReadFile("testdata/entities_added.json")
+		a.eventChannel <- replaceId(event, "123456789", id)
+		return fakeFile("testdata/result_msg.json")(a, message, id)
+	},
+	"history/stream": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		a.historyStreamID = id
+		a.eventChannel <- []byte(`{"id": ` + id + `, "type": "event", "event": {
+			"states": {"light.kitchen": [{"s": "on", "a": {}, "lu": 1550340704.0}]},
+			"start_time": 1550337104.0, "end_time": 1550340705.0}}`)
+		return fakeFile("testdata/result_msg.json")(a, message, id)
+	},
+	"logbook/event_stream": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		a.eventChannel <- []byte(`{"id": ` + id + `, "type": "event", "event": {
+			"events": [{"when": 1550340704.5, "name": "Kitchen", "message": "turned on", "domain": "light",
+				"entity_id": "light.kitchen", "state": "on", "context_user_id": "31ddb597e03147118cf8d2f8fbea5553"}],
+			"start_time": 1550337104.0, "end_time": 1550340705.0, "partial": false}}`)
+		return fakeFile("testdata/result_msg.json")(a, message, id)
+	},
+	"recorder/statistics_during_period": fakeResult(`{
+		"sensor.energy": [
+			{"start": 1550340000000, "end": 1550343600000, "sum": 12.5, "state": 1012.5},
+			{"start": 1550343600000, "end": 1550347200000, "sum": 13.75, "state": 1013.75}]}`),
+	"recorder/list_statistic_ids": fakeResult(`[
+		{"statistic_id": "sensor.energy", "source": "recorder", "has_sum": true, "has_mean": false,
+		 "statistics_unit_of_measurement": "kWh", "unit_class": "energy"}]`),
+	"config/area_registry/list": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		atomic.AddInt64(&a.nrOfAreaLists, 1)
+		return fakeResult(`[
+			{"area_id": "kitchen", "name": "Kitchen", "aliases": ["Cookhouse"], "floor_id": null, "icon": null, "picture": null},
+			{"area_id": "living_room", "name": "Living Room", "aliases": [], "floor_id": null, "icon": null, "picture": null}]`)(a, message, id)
+	},
+	"config/area_registry/create": fakeStoreArea,
+	"config/area_registry/update": fakeStoreArea,
+	"config/device_registry/update": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		device, _ := json.Marshal(map[string]interface{}{"id": message["device_id"], "name": "Hue bridge",
+			"area_id": message["area_id"], "name_by_user": message["name_by_user"]})
+		return fakeResult(string(device))(a, message, id)
+	},
+	"config/entity_registry/get": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		entry, _ := json.Marshal(map[string]interface{}{"entity_id": message["entity_id"], "platform": "hue",
+			"area_id": "garage"})
+		return fakeResult(string(entry))(a, message, id)
+	},
+	"config/entity_registry/update": func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		entityID, ok := message["new_entity_id"].(string)
+		if !ok {
+			entityID = message["entity_id"].(string)
+		}
+		entry, _ := json.Marshal(map[string]interface{}{"entity_id": entityID, "platform": "template",
+			"name": message["name"], "area_id": message["area_id"]})
+		return fakeResult(`{"entity_entry": `+string(entry)+`}`)(a, message, id)
+	},
+}
+
+// fakeFile responds with the content of the file
+func fakeFile(file string) fakeResponse {
+	return func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		resp, _ := ioutil.ReadFile(file)
+		return replaceId(resp, "123456789", id)
+	}
+}
+
+// fakeResult responds with a successful result
+func fakeResult(result string) fakeResponse {
+	return func(a *fakeConnected, message map[string]interface{}, id string) []byte {
+		return []byte(`{"id": ` + id + `, "type": "result", "success": true, "result": ` + result + `}`)
+	}
+}
+
+// fakeStoreArea responds to area create and update with the sent area
+func fakeStoreArea(a *fakeConnected, message map[string]interface{}, id string) []byte {
+	a.areaMessage = message
+	areaID, ok := message["area_id"].(string)
+	if !ok {
+		areaID = strings.ToLower(message["name"].(string))
+	}
+	area, _ := json.Marshal(map[string]interface{}{"area_id": areaID, "name": message["name"], "aliases": message["aliases"],
+		"icon": message["icon"]})
+	return fakeResult(string(area))(a, message, id)
+}
 func (a *fakeConnected) IsClosed() bool {
 	return a.isClosed
 }
@@ -277,6 +1044,24 @@ func (a *fakeConnected) SimulateCallServiceEvent() {
 	esp, _ := ioutil.ReadFile("testdata/service_event.json")
 	a.eventChannel <- esp
 }
+func (a *fakeConnected) SimulateEntitiesChanged() {
+	esp, _ := ioutil.ReadFile("testdata/entities_changed.json")
+	a.eventChannel <- replaceId(esp, "123456789", a.subscribeEntitiesID)
+}
+func (a *fakeConnected) SimulateRegistryUpdated(eventType string, data string) {
+	a.eventChannel <- []byte(`{"id": 1, "type": "event", "event": {"event_type": "` + eventType + `",
+		"data": ` + data + `, "origin": "LOCAL", "time_fired": "2019-02-16T18:11:44.183673+00:00"}}`)
+}
+func (a *fakeConnected) SimulateHistoryStreamEvent() {
+	a.eventChannel <- []byte(`{"id": ` + a.historyStreamID + `, "type": "event", "event": {
+		"states": {"light.kitchen": [{"s": "off", "lu": 1550340800.0}]}}}`)
+}
+func (a *fakeConnected) SimulateCoalescedEvents() {
+	event, _ := ioutil.ReadFile("testdata/event.json")
+	serviceEvent, _ := ioutil.ReadFile("testdata/service_event.json")
+	frame := "[" + string(event) + "," + string(serviceEvent) + "]"
+	a.eventChannel <- []byte(frame)
+}
 func replaceId(response []byte, old string, new string) []byte {
 	res := string(response)
 	replaced := strings.Replace(res, old, new, -1)
@@ -292,8 +1077,9 @@ type fakeHassAPIPoster struct {
 	url           string
 }
 
-func (a *fakeHassAPIPoster) HassHTTPPostAPI(url string, data []byte) bool {
+func (a *fakeHassAPIPoster) HassHTTPPostAPI(url string, data []byte) (int, []byte, error) {
 	a.nrOfPostCalls = a.nrOfPostCalls + 1
 	a.url = url
-	return true
+	// Home Assistant returns the stored state
+	return 200, data, nil
 }
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HistoryOptions limits what history returns
+type HistoryOptions struct {
+	// MinimalResponse only returns attributes for the first state, the
+	// other states only have state and last changed
+	MinimalResponse bool
+	// SignificantChangesOnly leaves out changes of attributes only, for
+	// the domains where Home Assistant considers them insignificant
+	SignificantChangesOnly bool
+	// NoAttributes leaves out all attributes
+	NoAttributes bool
+}
+
+// HassHistory holds the states of each entity in time order
+type HassHistory map[string][]HassEntityState
+
+// History returns the states of the entities between start and end, a zero
+// end means until now. Uses the websocket history/history_during_period
+// command.
+func (a *Recorder) History(ctx context.Context, entityIDs []string, start, end time.Time, options HistoryOptions) (HassHistory, error) {
+	message := historyMessage("history/history_during_period", entityIDs, start, end, options)
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	var states map[string][]compressedState
+	if err := result.decodeResult(&states); err != nil {
+		return nil, fmt.Errorf("failed to decode history: %v", err)
+	}
+	return newCompressedHistory(states, a.hass.location())
+}
+
+// HistoryStreamEvent is the states received from a history stream
+type HistoryStreamEvent struct {
+	States HassHistory
+	// StartTime and EndTime is the period the states cover
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// historyStreamEvent is the event of the history/stream command
+type historyStreamEvent struct {
+	States    map[string][]compressedState `json:"states"`
+	StartTime float64                      `json:"start_time"`
+	EndTime   float64                      `json:"end_time"`
+}
+
+// StreamHistory streams the states of the entities from start using the
+// websocket history/stream command. The first event has the past states,
+// then live changes are sent until end, or until unsubscribed if end is
+// zero. The handle is called for each event in order.
+func (a *Recorder) StreamHistory(ctx context.Context, entityIDs []string, start, end time.Time, options HistoryOptions, handle func(HistoryStreamEvent)) (*Subscription, error) {
+	message := historyMessage("history/stream", entityIDs, start, end, options)
+	return a.hass.subscribeCommand(ctx, message, func(result Result) {
+		var event historyStreamEvent
+		if err := result.decodeEvent(&event); err != nil {
+			log.Errorf("Failed to decode history stream event: %v", err)
+			return
+		}
+		location := a.hass.location()
+		states, err := newCompressedHistory(event.States, location)
+		if err != nil {
+			log.Errorf("Failed to decode history stream event: %v", err)
+			return
+		}
+		streamEvent := HistoryStreamEvent{States: states}
+		streamEvent.StartTime = compressedTime(event.StartTime, location)
+		streamEvent.EndTime = compressedTime(event.EndTime, location)
+		handle(streamEvent)
+	})
+}
+
+// historyMessage makes the message of the websocket history commands
+func historyMessage(messageType string, entityIDs []string, start, end time.Time, options HistoryOptions) map[string]interface{} {
+	message := map[string]interface{}{
+		"type":                     messageType,
+		"start_time":               start.UTC().Format(time.RFC3339Nano),
+		"entity_ids":               entityIDs,
+		"minimal_response":         options.MinimalResponse,
+		"significant_changes_only": options.SignificantChangesOnly,
+		"no_attributes":            options.NoAttributes}
+	if !end.IsZero() {
+		message["end_time"] = end.UTC().Format(time.RFC3339Nano)
+	}
+	return message
+}
+
+// newCompressedHistory converts history in the compressed format of the
+// websocket API
+func newCompressedHistory(states map[string][]compressedState, location *time.Location) (HassHistory, error) {
+	history := make(HassHistory, len(states))
+	for entityID, entityStates := range states {
+		series := make([]HassEntityState, 0, len(entityStates))
+		for _, compressed := range entityStates {
+			state, err := compressed.newState(location)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode history of %s: %v", entityID, err)
+			}
+			series = append(series, state)
+		}
+		history[entityID] = series
+	}
+	return history, nil
+}
+
+// History returns the states of the entities between start and end, a zero
+// end means until now. Uses /api/history/period.
+func (a *RestClient) History(ctx context.Context, entityIDs []string, start, end time.Time, options HistoryOptions) (HassHistory, error) {
+	query := url.Values{}
+	query.Set("filter_entity_id", strings.Join(entityIDs, ","))
+	if !end.IsZero() {
+		query.Set("end_time", end.UTC().Format(time.RFC3339Nano))
+	}
+	if options.MinimalResponse {
+		query.Set("minimal_response", "")
+	}
+	if options.SignificantChangesOnly {
+		query.Set("significant_changes_only", "")
+	}
+	if options.NoAttributes {
+		query.Set("no_attributes", "")
+	}
+	apiPath := "history/period/" + url.PathEscape(start.UTC().Format(time.RFC3339Nano))
+
+	var result [][]StateData
+	if _, err := a.do(ctx, "GET", apiPath, query, nil, &result); err != nil {
+		return nil, err
+	}
+	history := make(HassHistory, len(result))
+	for _, entityStates := range result {
+		if len(entityStates) == 0 {
+			continue
+		}
+		// Only the first state has the entity id with minimal response
+		entityID := entityStates[0].EntityId
+		series := make([]HassEntityState, 0, len(entityStates))
+		for _, data := range entityStates {
+			state, err := newHassEntityState(data, a.location)
+			if err != nil {
+				log.Errorf("Failed to decode history of %s: %v", entityID, err)
+			}
+			// Minimal response only has last_changed
+			if data.LastUpdated == "" {
+				state.LastUpdated = state.LastChanged
+				state.LastReported = state.LastChanged
+			}
+			series = append(series, state)
+		}
+		history[entityID] = series
+	}
+	return history, nil
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// validIDPart returns true if the part of an entity or statistic id only
+// has lower case letters, digits and single underscores inside
+func validIDPart(part string) bool {
+	if part == "" || strings.HasPrefix(part, "_") || strings.HasSuffix(part, "_") ||
+		strings.Contains(part, "__") {
+		return false
+	}
+	for _, c := range part {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateStatisticID checks the id against the source, statistics of the
+// recorder use entity ids like sensor.energy and external statistics use
+// the source as prefix like my_meter:energy
+func validateStatisticID(statisticID string, source string) error {
+	if source == "recorder" {
+		parts := strings.Split(statisticID, ".")
+		if len(parts) != 2 || !validIDPart(parts[0]) || !validIDPart(parts[1]) {
+			return fmt.Errorf("invalid statistic id %q, recorder statistics use entity ids like sensor.energy", statisticID)
+		}
+		return nil
+	}
+	parts := strings.Split(statisticID, ":")
+	if len(parts) != 2 || !validIDPart(parts[0]) || !validIDPart(parts[1]) {
+		return fmt.Errorf("invalid statistic id %q, external statistics use ids like %s:energy", statisticID, source)
+	}
+	if parts[0] != source {
+		return fmt.Errorf("statistic id %q does not start with the source %q", statisticID, source)
+	}
+	return nil
+}
+
+// validateStatisticsImport checks the metadata and statistics before
+// importing, Home Assistant only reports the first problem it finds
+func validateStatisticsImport(metadata StatisticMetadata, statistics []Statistic) error {
+	if metadata.Source == "" {
+		return fmt.Errorf("missing source of statistic %q", metadata.StatisticID)
+	}
+	if !validIDPart(metadata.Source) {
+		return fmt.Errorf("invalid source %q", metadata.Source)
+	}
+	if err := validateStatisticID(metadata.StatisticID, metadata.Source); err != nil {
+		return err
+	}
+	if len(statistics) == 0 {
+		return fmt.Errorf("no statistics to import for %q", metadata.StatisticID)
+	}
+	for _, statistic := range statistics {
+		if statistic.Start.IsZero() {
+			return fmt.Errorf("missing start of statistic %q", metadata.StatisticID)
+		}
+		if !statistic.Start.Truncate(time.Hour).Equal(statistic.Start) {
+			return fmt.Errorf("start %s of statistic %q is not at the top of an hour",
+				statistic.Start.Format(time.RFC3339Nano), metadata.StatisticID)
+		}
+		if !metadata.HasMean && (statistic.Mean != nil || statistic.Min != nil || statistic.Max != nil) {
+			return fmt.Errorf("statistic %q has mean, min or max values but not HasMean", metadata.StatisticID)
+		}
+		if !metadata.HasSum && statistic.Sum != nil {
+			return fmt.Errorf("statistic %q has sum values but not HasSum", metadata.StatisticID)
+		}
+	}
+	return nil
+}
+
+// ImportStatistics imports long-term statistics, like energy data from an
+// external meter. Statistics with the same start replaces existing ones.
+// Only Start, LastReset, Mean, Min, Max, Sum and State of the statistics
+// are imported and Start has to be at the top of an hour.
+func (a *Recorder) ImportStatistics(ctx context.Context, metadata StatisticMetadata, statistics []Statistic) error {
+	if err := validateStatisticsImport(metadata, statistics); err != nil {
+		return err
+	}
+	meta := map[string]interface{}{
+		"statistic_id":        metadata.StatisticID,
+		"source":              metadata.Source,
+		"name":                nil,
+		"unit_of_measurement": nil,
+		"has_mean":            metadata.HasMean,
+		"has_sum":             metadata.HasSum}
+	if metadata.Name != "" {
+		meta["name"] = metadata.Name
+	}
+	if metadata.UnitOfMeasurement != "" {
+		meta["unit_of_measurement"] = metadata.UnitOfMeasurement
+	}
+	// Older versions of Home Assistant do not know unit_class
+	if metadata.UnitClass != "" {
+		meta["unit_class"] = metadata.UnitClass
+	}
+
+	stats := make([]map[string]interface{}, 0, len(statistics))
+	for _, statistic := range statistics {
+		stat := map[string]interface{}{"start": statistic.Start.UTC().Format(time.RFC3339Nano)}
+		if !statistic.LastReset.IsZero() {
+			stat["last_reset"] = statistic.LastReset.UTC().Format(time.RFC3339Nano)
+		}
+		values := map[string]*float64{
+			"mean":  statistic.Mean,
+			"min":   statistic.Min,
+			"max":   statistic.Max,
+			"sum":   statistic.Sum,
+			"state": statistic.State}
+		for key, value := range values {
+			if value != nil {
+				stat[key] = *value
+			}
+		}
+		stats = append(stats, stat)
+	}
+
+	_, err := a.hass.sendCommand(ctx, map[string]interface{}{
+		"type":     "recorder/import_statistics",
+		"metadata": meta,
+		"stats":    stats})
+	return err
+}
+
+// AdjustSumStatistics adds adjustment to the sum of the statistic from
+// start, used to correct imported data. The unit is the unit of the
+// adjustment, empty uses the unit of the statistic.
+func (a *Recorder) AdjustSumStatistics(ctx context.Context, statisticID string, start time.Time, adjustment float64, unit string) error {
+	source := "recorder"
+	if i := strings.Index(statisticID, ":"); i >= 0 {
+		source = statisticID[:i]
+	}
+	if err := validateStatisticID(statisticID, source); err != nil {
+		return err
+	}
+	message := map[string]interface{}{
+		"type":                           "recorder/adjust_sum_statistics",
+		"statistic_id":                   statisticID,
+		"start_time":                     start.UTC().Format(time.RFC3339Nano),
+		"adjustment":                     adjustment,
+		"adjustment_unit_of_measurement": nil}
+	if unit != "" {
+		message["adjustment_unit_of_measurement"] = unit
+	}
+	_, err := a.hass.sendCommand(ctx, message)
+	return err
+}
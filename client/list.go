@@ -33,6 +33,24 @@ func (a *List) SetEntity(entity *HassEntity) {
 	a.entities[entity.ID] = *entity
 }
 
+// RemoveEntity removes the entity from the map
+func (a *List) RemoveEntity(entityID string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	delete(a.entities, entityID)
+}
+
+// entityIDs returns the ids of all entities
+func (a *List) entityIDs() []string {
+	a.m.Lock()
+	defer a.m.Unlock()
+	entityIDs := make([]string, 0, len(a.entities))
+	for entityID := range a.entities {
+		entityIDs = append(entityIDs, entityID)
+	}
+	return entityIDs
+}
+
 // ByID sorting by the id
 type ByID []HassEntity
 
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LogbookEntry is an entry of the Home Assistant logbook
+type LogbookEntry struct {
+	When     time.Time
+	Name     string
+	Message  string
+	Domain   string
+	EntityID string
+	State    string
+	// ContextUserID is the user that caused the entry, empty if not caused
+	// by a user
+	ContextUserID string
+	ContextID     string
+	// ContextEventType, ContextDomain and ContextService tells what caused
+	// the entry, like an automation or a service call
+	ContextEventType string
+	ContextDomain    string
+	ContextService   string
+	ContextEntityID  string
+}
+
+// LogbookStreamEvent is the entries received from a logbook stream
+type LogbookStreamEvent struct {
+	Entries []LogbookEntry
+	// StartTime and EndTime is the period the entries cover, only set for
+	// the past entries
+	StartTime time.Time
+	EndTime   time.Time
+	// Partial is true when more past entries follow
+	Partial bool
+}
+
+// logbookData is a logbook entry, when is a timestamp in the REST API and
+// unix time in the websocket API
+type logbookData struct {
+	When             json.RawMessage `json:"when"`
+	Name             string          `json:"name"`
+	Message          string          `json:"message"`
+	Domain           string          `json:"domain"`
+	EntityID         string          `json:"entity_id"`
+	State            string          `json:"state"`
+	ContextUserID    string          `json:"context_user_id"`
+	ContextID        string          `json:"context_id"`
+	ContextEventType string          `json:"context_event_type"`
+	ContextDomain    string          `json:"context_domain"`
+	ContextService   string          `json:"context_service"`
+	ContextEntityID  string          `json:"context_entity_id"`
+}
+
+// logbookStreamEvent is the event of the logbook/event_stream command
+type logbookStreamEvent struct {
+	Events    []logbookData `json:"events"`
+	StartTime float64       `json:"start_time"`
+	EndTime   float64       `json:"end_time"`
+	Partial   bool          `json:"partial"`
+}
+
+// newLogbookEntries converts the logbook entries from Home Assistant
+func newLogbookEntries(data []logbookData, location *time.Location) ([]LogbookEntry, error) {
+	entries := make([]LogbookEntry, 0, len(data))
+	for _, entry := range data {
+		when, err := logbookTime(entry.When, location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode logbook entry of %s: when: %v", entry.EntityID, err)
+		}
+		entries = append(entries, LogbookEntry{
+			When:             when,
+			Name:             entry.Name,
+			Message:          entry.Message,
+			Domain:           entry.Domain,
+			EntityID:         entry.EntityID,
+			State:            entry.State,
+			ContextUserID:    entry.ContextUserID,
+			ContextID:        entry.ContextID,
+			ContextEventType: entry.ContextEventType,
+			ContextDomain:    entry.ContextDomain,
+			ContextService:   entry.ContextService,
+			ContextEntityID:  entry.ContextEntityID})
+	}
+	return entries, nil
+}
+
+// logbookTime decodes when, either a timestamp or unix time
+func logbookTime(data json.RawMessage, location *time.Location) (time.Time, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return time.Time{}, err
+		}
+		return parseHassTime(value, location)
+	}
+	var value float64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return time.Time{}, err
+	}
+	return compressedTime(value, location), nil
+}
+
+// Logbook returns the logbook entries between start and end, a zero end
+// means until now. No entity ids returns entries of all entities.
+func (a *Recorder) Logbook(ctx context.Context, start, end time.Time, entityIDs []string) ([]LogbookEntry, error) {
+	return a.hass.REST().Logbook(ctx, start, end, entityIDs)
+}
+
+// StreamLogbook streams the logbook entries from start using the websocket
+// logbook/event_stream command. First the past entries are sent, then live
+// entries until end, or until unsubscribed if end is zero. No entity ids
+// streams entries of all entities.
+func (a *Recorder) StreamLogbook(ctx context.Context, start, end time.Time, entityIDs []string, handle func(LogbookStreamEvent)) (*Subscription, error) {
+	message := map[string]interface{}{
+		"type":       "logbook/event_stream",
+		"start_time": start.UTC().Format(time.RFC3339Nano)}
+	if !end.IsZero() {
+		message["end_time"] = end.UTC().Format(time.RFC3339Nano)
+	}
+	if len(entityIDs) > 0 {
+		message["entity_ids"] = entityIDs
+	}
+	return a.hass.subscribeCommand(ctx, message, func(result Result) {
+		var event logbookStreamEvent
+		if err := result.decodeEvent(&event); err != nil {
+			log.Errorf("Failed to decode logbook stream event: %v", err)
+			return
+		}
+		location := a.hass.location()
+		entries, err := newLogbookEntries(event.Events, location)
+		if err != nil {
+			log.Errorf("Failed to decode logbook stream event: %v", err)
+			return
+		}
+		streamEvent := LogbookStreamEvent{Entries: entries, Partial: event.Partial}
+		streamEvent.StartTime = compressedTime(event.StartTime, location)
+		streamEvent.EndTime = compressedTime(event.EndTime, location)
+		handle(streamEvent)
+	})
+}
+
+// Logbook returns the logbook entries between start and end, a zero end
+// means until now. No entity ids returns entries of all entities. Uses
+// /api/logbook.
+func (a *RestClient) Logbook(ctx context.Context, start, end time.Time, entityIDs []string) ([]LogbookEntry, error) {
+	query := url.Values{}
+	if !end.IsZero() {
+		query.Set("end_time", end.UTC().Format(time.RFC3339Nano))
+	}
+	if len(entityIDs) > 0 {
+		query.Set("entity", strings.Join(entityIDs, ","))
+	}
+	apiPath := "logbook/" + url.PathEscape(start.UTC().Format(time.RFC3339Nano))
+
+	var result []logbookData
+	if _, err := a.do(ctx, "GET", apiPath, query, nil, &result); err != nil {
+		return nil, err
+	}
+	return newLogbookEntries(result, a.location)
+}
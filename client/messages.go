@@ -1,26 +1,134 @@
 package client
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Result is a message from the Home Assistant websocket API. The result
+// and event payloads are decoded depending on the command or event type.
 type Result struct {
-	Id          int64       `json:"id"`
-	MessageType string      `json:"type"`
-	Success     bool        `json:"success"`
-	Result      interface{} `json:"result"`
-	Event       Event       `json:"event"`
+	Id          int64           `json:"id"`
+	MessageType string          `json:"type"`
+	Success     bool            `json:"success"`
+	Result      json.RawMessage `json:"result"`
+	Event       json.RawMessage `json:"event"`
+	Error       ErrorData       `json:"error"`
 }
 
-type GetResult struct {
-	EntityId    string                 `json:"entity_id"`
-	LastChanged string                 `json:"last_changed"`
-	LastUpdated string                 `json:"last_updated"`
-	State       string                 `json:"state"`
-	Attributes  map[string]interface{} `json:"attributes"`
+// decodeResult decodes the result payload into v
+func (a Result) decodeResult(v interface{}) error {
+	return json.Unmarshal(a.Result, v)
+}
+
+// decodeEvent decodes the event payload into v
+func (a Result) decodeEvent(v interface{}) error {
+	return json.Unmarshal(a.Event, v)
+}
+
+// decodeStates decodes the result of get_states one state at the time and
+// calls handle for each
+func decodeStates(data []byte, handle func(StateData)) error {
+	return decodeStateList(json.NewDecoder(bytes.NewReader(data)), handle)
+}
+
+// decodeStatesMessage decodes the states of a get_states result message
+// without copying the result out of the message first. Only the state
+// being decoded is buffered.
+func decodeStatesMessage(message []byte, handle func(StateData)) error {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if key == "result" {
+			return decodeStateList(decoder, handle)
+		}
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	return errors.New("no result in get_states message")
+}
+
+// decodeStateList decodes the list of states the decoder is at
+func decodeStateList(decoder *json.Decoder, handle func(StateData)) error {
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	for decoder.More() {
+		var state StateData
+		if err := decoder.Decode(&state); err != nil {
+			return err
+		}
+		handle(state)
+	}
+	// Consume the closing ]
+	_, err := decoder.Token()
+	return err
+}
+
+// expectDelim reads the next token, an error if it is not delim
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if found, ok := token.(json.Delim); !ok || found != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+type ErrorData struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ContextData struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	ParentID string `json:"parent_id"`
+}
+
+func (a ContextData) hassContext() HassContext {
+	return HassContext{ID: a.ID, UserID: a.UserID, ParentID: a.ParentID}
+}
+
+// ConfigData is the result of the get_config command
+type ConfigData struct {
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	Elevation    float64 `json:"elevation"`
+	TimeZone     string  `json:"time_zone"`
+	LocationName string  `json:"location_name"`
+	Version      string  `json:"version"`
+}
+
+// CallServiceResult is the result of the call_service command
+type CallServiceResult struct {
+	Context ContextData `json:"context"`
 }
+
 type Event struct {
-	Data      EventData `json:"data"`
-	EventType string    `json:"event_type"`
-	TimeFired string    `json:"time_fired"`
+	Data      json.RawMessage `json:"data"`
+	EventType string          `json:"event_type"`
+	TimeFired string          `json:"time_fired"`
+	Origin    string          `json:"origin"`
+	Context   ContextData     `json:"context"`
 }
 
+// EventData has the fields of both state_changed and call_service events.
+//
+// Deprecated: Event.Data is decoded per event type, use StateChangedData or
+// CallServiceData.
 type EventData struct {
 	EntityId    string                 `json:"entity_id"`
 	NewState    StateData              `json:"new_state"`
@@ -30,11 +138,28 @@ type EventData struct {
 	ServiceData map[string]interface{} `json:"service_data"`
 }
 
+// StateChangedData is the data of the state_changed event
+type StateChangedData struct {
+	EntityId string    `json:"entity_id"`
+	NewState StateData `json:"new_state"`
+	OldState StateData `json:"old_state"`
+}
+
+// CallServiceData is the data of the call_service event
+type CallServiceData struct {
+	Domain      string                 `json:"domain"`
+	Service     string                 `json:"service"`
+	ServiceData map[string]interface{} `json:"service_data"`
+}
+
 type StateData struct {
-	LastChanged string                 `json:"last_changed"`
-	LastUpdated string                 `json:"last_updated"`
-	State       interface{}            `json:"state"`
-	Attributes  map[string]interface{} `json:"attributes"`
+	EntityId     string                 `json:"entity_id"`
+	LastChanged  string                 `json:"last_changed"`
+	LastUpdated  string                 `json:"last_updated"`
+	LastReported string                 `json:"last_reported"`
+	State        interface{}            `json:"state"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	Context      ContextData            `json:"context"`
 }
 
 type SetStateData struct {
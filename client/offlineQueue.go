@@ -0,0 +1,384 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/helto4real/go-hassclient/internal/wsocket"
+	"github.com/helto4real/go-hassclient/transport"
+)
+
+var (
+	// ErrQueued is returned when a command is queued until Home Assistant
+	// is connected again
+	ErrQueued = errors.New("command queued until connected to Home Assistant")
+	// ErrQueueFull is returned when the offline queue can not hold more commands
+	ErrQueueFull = errors.New("offline queue is full")
+)
+
+// QueueOptions controls how a command is held in the offline queue
+type QueueOptions struct {
+	// Key identifies the command, a queued command with the same key is
+	// replaced by the new one. Empty key never replaces.
+	Key string
+	// TTL is how long the command may wait to be sent, zero never expires
+	TTL time.Duration
+}
+
+// QueuedCommand is a service call or entity state held while disconnected
+type QueuedCommand struct {
+	QueueOptions
+	// QueuedAt is when the command was queued
+	QueuedAt time.Time
+	// Service and ServiceData is set for service calls
+	Service     string
+	ServiceData map[string]string
+	// Entity is set when setting an entity state
+	Entity *HassEntity
+}
+
+// HassCommandExpired is sent on the Hass channel when a queued command
+// expired before it could be sent
+type HassCommandExpired struct {
+	Command QueuedCommand
+}
+
+// HassCommandDropped is sent on the Hass channel when a queued command is
+// dropped since the queue is full
+type HassCommandDropped struct {
+	Command QueuedCommand
+}
+
+// expired returns true if the command has waited longer than its TTL
+func (a QueuedCommand) expired(now time.Time) bool {
+	return a.TTL > 0 && now.Sub(a.QueuedAt) > a.TTL
+}
+
+// offlineQueue holds commands in order while disconnected
+type offlineQueue struct {
+	commands []QueuedCommand
+	// sending are the taken commands not yet sent, still kept in the store
+	sending []QueuedCommand
+	size    int
+	// holding is true while disconnected and until the queue is replayed,
+	// new commands are queued behind the ones waiting
+	holding bool
+	store   QueueStore
+	m       sync.Mutex
+}
+
+// hold queues the command if commands are held, returns false if the
+// command should be sent directly
+func (a *offlineQueue) hold(command QueuedCommand) (bool, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if !a.holding {
+		return false, nil
+	}
+	return true, a.addLocked(command)
+}
+
+// add queues the command, replacing a queued command with the same key
+func (a *offlineQueue) add(command QueuedCommand) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.addLocked(command)
+}
+
+func (a *offlineQueue) addLocked(command QueuedCommand) error {
+	if command.Key != "" {
+		for i, queued := range a.commands {
+			if queued.Key == command.Key {
+				a.commands = append(a.commands[:i], a.commands[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(a.commands) >= a.size {
+		return ErrQueueFull
+	}
+	a.commands = append(a.commands, command)
+	a.saveLocked()
+	return nil
+}
+
+// take removes and returns all queued commands, if none are queued the
+// commands are no longer held and nil is returned
+func (a *offlineQueue) take() []QueuedCommand {
+	a.m.Lock()
+	defer a.m.Unlock()
+	commands := a.commands
+	a.commands = nil
+	a.sending = commands
+	if len(commands) == 0 {
+		a.holding = false
+	}
+	return commands
+}
+
+// sent removes the first taken command from the store once it is handled
+func (a *offlineQueue) sent() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if len(a.sending) > 0 {
+		a.sending = a.sending[1:]
+		a.saveLocked()
+	}
+}
+
+// putBack returns commands that could not be sent to the front of the
+// queue. The newest commands that do not fit are dropped and returned.
+func (a *offlineQueue) putBack(commands []QueuedCommand) []QueuedCommand {
+	a.m.Lock()
+	defer a.m.Unlock()
+	all := append(append([]QueuedCommand{}, commands...), a.commands...)
+	a.sending = nil
+	defer a.saveLocked()
+	if len(all) <= a.size {
+		a.commands = all
+		return nil
+	}
+	a.commands = all[:a.size]
+	return all[a.size:]
+}
+
+// saveLocked writes the commands not yet sent to the store, if any
+func (a *offlineQueue) saveLocked() {
+	if a.store == nil {
+		return
+	}
+	all := append(append([]QueuedCommand{}, a.sending...), a.commands...)
+	if err := a.store.Save(all); err != nil {
+		log.Errorf("Failed to save offline queue: %v", err)
+	}
+}
+
+// holdAll makes new commands queue until replayed, used when disconnected
+func (a *offlineQueue) holdAll() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.holding = true
+}
+
+// len returns the number of queued commands
+func (a *offlineQueue) len() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return len(a.commands)
+}
+
+// WithOfflineQueue holds service calls and entity states made while
+// disconnected and sends them in order once connected again. The queue holds
+// at most size commands and keeps them in store, commands stored by an
+// earlier run are sent when connected. A command is removed from the store
+// once sent, so it may be sent again if the process exits while sending.
+func WithOfflineQueue(size int, store QueueStore) Option {
+	return func(a *homeAssistantPlatform) {
+		a.offlineQueue = &offlineQueue{size: size, holding: true, store: store}
+		commands, err := store.Load()
+		if err != nil {
+			log.Errorf("Failed to load offline queue: %v", err)
+			return
+		}
+		if len(commands) > size {
+			commands = commands[:size]
+		}
+		a.offlineQueue.commands = commands
+	}
+}
+
+// WithInMemoryOfflineQueue is WithOfflineQueue without a store, queued
+// commands are lost if the process exits
+func WithInMemoryOfflineQueue(size int) Option {
+	return func(a *homeAssistantPlatform) {
+		a.offlineQueue = &offlineQueue{size: size, holding: true}
+	}
+}
+
+// isReady returns true when connected and all states are synced
+func (a *homeAssistantPlatform) isReady() bool {
+	return atomic.LoadInt32(&a.ready) == 1
+}
+
+// setReady notifies that the client is ready and sends queued commands
+func (a *homeAssistantPlatform) setReady() {
+	atomic.StoreInt32(&a.ready, 1)
+	log.Info("Home Assistant integration ready!")
+	a.HassStatusChannel <- true
+	// Home Assistant may have restarted and forgotten the virtual entities
+	go a.virtualEntities.publishAll()
+	if a.registry.cached {
+		go a.registry.load(a.context)
+	}
+	if a.offlineQueue != nil {
+		go a.replayQueue()
+	}
+}
+
+// isConnectionError returns true if the error means the command never
+// reached Home Assistant
+func isConnectionError(err error) bool {
+	return err == ErrNotConnected || err == ws.ErrClosed || err == transport.ErrClosed
+}
+
+// CallServiceQueued makes a service call, if not connected it is queued
+// with the options and ErrQueued is returned
+func (a *homeAssistantPlatform) CallServiceQueued(service string, serviceData map[string]string, options QueueOptions) (string, error) {
+	return a.callServiceQueued(context.Background(), service, serviceData, options)
+}
+
+func (a *homeAssistantPlatform) callServiceQueued(ctx context.Context, service string, serviceData map[string]string, options QueueOptions) (string, error) {
+	if a.offlineQueue == nil {
+		return a.callService(ctx, service, serviceData)
+	}
+	// The context limits how long the call may wait in the queue
+	if deadline, ok := ctx.Deadline(); ok {
+		ttl := time.Until(deadline)
+		if ttl <= 0 {
+			return "", context.DeadlineExceeded
+		}
+		if options.TTL == 0 || ttl < options.TTL {
+			options.TTL = ttl
+		}
+	}
+	command := newQueuedCommand(options)
+	command.Service = service
+	command.ServiceData = make(map[string]string, len(serviceData))
+	for key, value := range serviceData {
+		command.ServiceData[key] = value
+	}
+	if held, err := a.offlineQueue.hold(command); held {
+		return "", a.queued(command, err)
+	}
+	contextID, err := a.callService(ctx, service, serviceData)
+	if !isConnectionError(err) {
+		return contextID, err
+	}
+	return "", a.queued(command, a.offlineQueue.add(command))
+}
+
+// SetEntityQueued sets the entity state, if not connected it is queued with
+// the options and ErrQueued is returned
+func (a *homeAssistantPlatform) SetEntityQueued(entity *HassEntity, options QueueOptions) error {
+	_, err := a.setEntityQueued(entity, options)
+	return err
+}
+
+func (a *homeAssistantPlatform) setEntityQueued(entity *HassEntity, options QueueOptions) (SetEntityResult, error) {
+	if a.offlineQueue == nil {
+		return a.setEntity(entity)
+	}
+	// The caller may change the entity while it is queued
+	command := newQueuedCommand(options)
+	copied := *entity
+	copied.New.Attributes = make(map[string]interface{}, len(entity.New.Attributes))
+	for key, value := range entity.New.Attributes {
+		copied.New.Attributes[key] = value
+	}
+	command.Entity = &copied
+
+	if held, err := a.offlineQueue.hold(command); held {
+		return SetEntityResult{}, a.queued(command, err)
+	}
+	result, err := a.setEntity(entity)
+	if err == nil || a.isReady() {
+		return result, err
+	}
+	return SetEntityResult{}, a.queued(command, a.offlineQueue.add(command))
+}
+
+// QueuedCommands returns the number of commands in the offline queue
+func (a *homeAssistantPlatform) QueuedCommands() int {
+	if a.offlineQueue == nil {
+		return 0
+	}
+	return a.offlineQueue.len()
+}
+
+// newQueuedCommand makes a command queued now
+func newQueuedCommand(options QueueOptions) QueuedCommand {
+	return QueuedCommand{QueueOptions: options, QueuedAt: time.Now()}
+}
+
+// queued returns ErrQueued if the command was queued, otherwise the error
+// from the queue
+func (a *homeAssistantPlatform) queued(command QueuedCommand, err error) error {
+	if err != nil {
+		return err
+	}
+	log.Debugf("Not connected, queued command %s%s", command.Service, entityID(command.Entity))
+	return ErrQueued
+}
+
+// replayQueue sends the queued commands in order, expired commands are
+// reported on the Hass channel. Commands queued while replaying are sent
+// before new commands are sent directly.
+func (a *homeAssistantPlatform) replayQueue() {
+	for a.isReady() {
+		commands := a.offlineQueue.take()
+		if len(commands) == 0 {
+			return
+		}
+		if !a.replayCommands(commands) {
+			return
+		}
+	}
+}
+
+// replayCommands sends the commands in order, returns false if the
+// connection was lost and the rest are put back in the queue
+func (a *homeAssistantPlatform) replayCommands(commands []QueuedCommand) bool {
+	for i, command := range commands {
+		if !a.replayCommand(command) {
+			// Lost connection again, wait for next time
+			a.putBack(commands[i:])
+			return false
+		}
+		a.offlineQueue.sent()
+	}
+	return true
+}
+
+// replayCommand sends a queued command, returns false if the connection was
+// lost before it was sent
+func (a *homeAssistantPlatform) replayCommand(command QueuedCommand) bool {
+	if command.expired(time.Now()) {
+		log.Warnf("Queued command %s%s expired", command.Service, entityID(command.Entity))
+		a.HassChannel <- HassCommandExpired{Command: command}
+		return true
+	}
+	if command.Entity != nil {
+		if _, err := a.setEntity(command.Entity); err != nil {
+			if !a.isReady() {
+				return false
+			}
+			log.Errorf("Queued state of %s failed: %v", command.Entity.ID, err)
+		}
+		return true
+	}
+	if _, err := a.callService(a.context, command.Service, command.ServiceData); err != nil {
+		if isConnectionError(err) || !a.isReady() {
+			return false
+		}
+		log.Errorf("Queued service call %s failed: %v", command.Service, err)
+	}
+	return true
+}
+
+// putBack queues the commands again and reports those that did not fit
+func (a *homeAssistantPlatform) putBack(commands []QueuedCommand) {
+	for _, command := range a.offlineQueue.putBack(commands) {
+		log.Warnf("Offline queue is full, dropped command %s%s", command.Service, entityID(command.Entity))
+		a.HassChannel <- HassCommandDropped{Command: command}
+	}
+}
+
+func entityID(entity *HassEntity) string {
+	if entity == nil {
+		return ""
+	}
+	return entity.ID
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// QueueStore keeps the commands of the offline queue so they survive a
+// restart of the process
+type QueueStore interface {
+	// Load returns the stored commands in the order they were queued
+	Load() ([]QueuedCommand, error)
+	// Save replaces the stored commands, an empty list removes them all
+	Save(commands []QueuedCommand) error
+}
+
+// fileQueueStore keeps the commands as JSON in a file
+type fileQueueStore struct {
+	path string
+}
+
+// NewFileQueueStore returns a QueueStore keeping the commands as JSON in the
+// file at path. The file is written every time the queue changes.
+func NewFileQueueStore(path string) QueueStore {
+	return &fileQueueStore{path: path}
+}
+
+func (a *fileQueueStore) Load() ([]QueuedCommand, error) {
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var commands []QueuedCommand
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+func (a *fileQueueStore) Save(commands []QueuedCommand) error {
+	data, err := json.Marshal(commands)
+	if err != nil {
+		return err
+	}
+	// Replace the file in one step so a crash never leaves half a queue
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
@@ -0,0 +1,12 @@
+package client
+
+// Recorder gives access to the history, logbook and long-term statistics
+// kept by the recorder of Home Assistant
+type Recorder struct {
+	hass *homeAssistantPlatform
+}
+
+// Recorder returns the history, logbook and statistics of Home Assistant
+func (a *homeAssistantPlatform) Recorder() *Recorder {
+	return a.recorder
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Events telling that a registry changed
+var registryEvents = []string{"area_registry_updated", "device_registry_updated", "entity_registry_updated"}
+
+// registryLoadTimeout is the longest time to load the registries when
+// connected
+const registryLoadTimeout = 5 * time.Second
+
+// registryRefreshDelay is how long to wait for more changes before listing
+// a changed area or device registry again
+const registryRefreshDelay = 500 * time.Millisecond
+
+// registryEvent is the data of the registry updated events
+type registryEvent struct {
+	// Action is "create", "update" or "remove"
+	Action   string `json:"action"`
+	AreaID   string `json:"area_id"`
+	DeviceID string `json:"device_id"`
+	EntityID string `json:"entity_id"`
+	// OldEntityID is set when the entity id changed
+	OldEntityID string `json:"old_entity_id"`
+}
+
+// Registry gives access to the area, device and entity registries of Home
+// Assistant. The cached methods, like Areas, require WithRegistryCache.
+type Registry struct {
+	hass *homeAssistantPlatform
+	// Keep the registries in memory
+	cached bool
+
+	areas    map[string]Area
+	devices  map[string]Device
+	entities map[string]RegistryEntry
+	m        sync.RWMutex
+
+	// Updates from events are applied one at a time
+	updateMutex sync.Mutex
+	// Pending list refresh of each registry event type
+	refresh map[string]*time.Timer
+}
+
+func newRegistry(hass *homeAssistantPlatform) *Registry {
+	return &Registry{
+		hass:     hass,
+		areas:    make(map[string]Area),
+		devices:  make(map[string]Device),
+		entities: make(map[string]RegistryEntry),
+		refresh:  make(map[string]*time.Timer)}
+}
+
+// WithRegistryCache loads the registries of Home Assistant when connected
+// and keeps them updated, they are then available without sending
+// commands. The registries are loaded after the client is ready.
+func WithRegistryCache() Option {
+	return func(a *homeAssistantPlatform) {
+		a.registry.cached = true
+	}
+}
+
+// Registry returns the area, device and entity registries
+func (a *homeAssistantPlatform) Registry() *Registry {
+	return a.registry
+}
+
+// load fills the registry cache, done in the background when the client is
+// ready so the cache may be empty for a moment
+func (a *Registry) load(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, registryLoadTimeout)
+	defer cancel()
+	a.updateMutex.Lock()
+	defer a.updateMutex.Unlock()
+
+	if _, err := a.ListAreas(ctx); err != nil {
+		log.Errorf("Failed to load area registry: %v", err)
+	}
+	if _, err := a.ListDevices(ctx); err != nil {
+		log.Errorf("Failed to load device registry: %v", err)
+	}
+	if _, err := a.ListEntries(ctx); err != nil {
+		log.Errorf("Failed to load entity registry: %v", err)
+	}
+}
+
+// handleEvent updates the registry cache with the changed item. Removed
+// items are deleted, changed entities are fetched and changed areas and
+// devices are listed again when no more changes come.
+func (a *Registry) handleEvent(event Event) {
+	if !a.cached {
+		return
+	}
+	var data registryEvent
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		log.Errorf("Failed to decode %s: %v", event.EventType, err)
+		return
+	}
+
+	a.updateMutex.Lock()
+	defer a.updateMutex.Unlock()
+
+	switch event.EventType {
+	case "area_registry_updated":
+		if data.Action == "remove" {
+			a.m.Lock()
+			delete(a.areas, data.AreaID)
+			a.m.Unlock()
+			return
+		}
+		a.refreshLater(event.EventType)
+	case "device_registry_updated":
+		if data.Action == "remove" {
+			a.m.Lock()
+			delete(a.devices, data.DeviceID)
+			a.m.Unlock()
+			return
+		}
+		a.refreshLater(event.EventType)
+	case "entity_registry_updated":
+		if data.Action == "remove" {
+			a.m.Lock()
+			delete(a.entities, data.EntityID)
+			a.m.Unlock()
+			return
+		}
+		if data.EntityID == "" {
+			a.refreshLater(event.EventType)
+			return
+		}
+		if _, err := a.FetchEntry(a.hass.context, data.EntityID); err != nil {
+			log.Errorf("Failed to update entity registry entry of %s: %v", data.EntityID, err)
+			return
+		}
+		if data.OldEntityID != "" {
+			a.m.Lock()
+			delete(a.entities, data.OldEntityID)
+			a.m.Unlock()
+		}
+	}
+}
+
+// refreshLater lists the registry again after registryRefreshDelay, a new
+// change of the same registry restarts the wait. Called with updateMutex.
+func (a *Registry) refreshLater(eventType string) {
+	if timer, ok := a.refresh[eventType]; ok && timer.Stop() {
+		timer.Reset(registryRefreshDelay)
+		return
+	}
+	a.refresh[eventType] = time.AfterFunc(registryRefreshDelay, func() {
+		a.updateMutex.Lock()
+		defer a.updateMutex.Unlock()
+		if a.hass.context.Err() != nil {
+			return
+		}
+		var err error
+		switch eventType {
+		case "area_registry_updated":
+			_, err = a.ListAreas(a.hass.context)
+		case "device_registry_updated":
+			_, err = a.ListDevices(a.hass.context)
+		case "entity_registry_updated":
+			_, err = a.ListEntries(a.hass.context)
+		}
+		if err != nil {
+			log.Errorf("Failed to refresh after %s: %v", eventType, err)
+		}
+	})
+}
+
+// joinRegistry sets the cached registry entry of the entity, a copy as it
+// is when the entity leaves the cache
+func (a *homeAssistantPlatform) joinRegistry(entity *HassEntity) *HassEntity {
+	if entry, ok := a.registry.GetEntry(entity.ID); ok {
+		entity.Registry = &entry
+	}
+	return entity
+}
+
+// subscribeEventsRegistryUpdated subscribes to the events of changed
+// registries, already included when subscribing to all events
+func (a *homeAssistantPlatform) subscribeEventsRegistryUpdated() {
+	for _, eventType := range registryEvents {
+		s := map[string]interface{}{
+			"id":         a.nextID(),
+			"type":       "subscribe_events",
+			"event_type": eventType}
+
+		a.send(s)
+	}
+}
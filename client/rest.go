@@ -0,0 +1,306 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// APIError is returned when the REST API responds with an error status
+type APIError struct {
+	StatusCode int
+	// Message is the error message from Home Assistant, or the body if it
+	// is not json
+	Message string
+	Body    []byte
+}
+
+// newAPIError makes the error from the response status and body
+func newAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Message: string(bytes.TrimSpace(body)), Body: body}
+	var message messageData
+	if json.Unmarshal(body, &message) == nil && message.Message != "" {
+		apiErr.Message = message.Message
+	}
+	return apiErr
+}
+
+func (a *APIError) Error() string {
+	if a.Message == "" {
+		return fmt.Sprintf("home assistant api: %d %s", a.StatusCode, http.StatusText(a.StatusCode))
+	}
+	return fmt.Sprintf("home assistant api: %d %s", a.StatusCode, a.Message)
+}
+
+// ServiceDomain lists the services of a domain
+type ServiceDomain struct {
+	Domain   string                        `json:"domain"`
+	Services map[string]ServiceDescription `json:"services"`
+}
+
+// ServiceDescription describes a service and its fields
+type ServiceDescription struct {
+	Name        string                  `json:"name"`
+	Description string                  `json:"description"`
+	Fields      map[string]ServiceField `json:"fields"`
+}
+
+// ServiceField describes a field of the service data
+type ServiceField struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Example     interface{} `json:"example"`
+	Required    bool        `json:"required"`
+}
+
+// EventListener is an event type and the number of listeners
+type EventListener struct {
+	Event         string `json:"event"`
+	ListenerCount int    `json:"listener_count"`
+}
+
+// CheckConfigResult is the result of checking configuration.yaml
+type CheckConfigResult struct {
+	// Result is "valid" or "invalid"
+	Result string `json:"result"`
+	Errors string `json:"errors"`
+}
+
+// messageData is the body of responses that only carry a message
+type messageData struct {
+	Message string `json:"message"`
+}
+
+// RestClient calls the REST API of Home Assistant, it does not need the
+// websocket connection
+type RestClient struct {
+	endpoint   endpoint
+	token      string
+	httpClient *http.Client
+	header     http.Header
+	location   *time.Location
+	// poster posts instead of the http client if set
+	poster HassHTTPPoster
+}
+
+// NewRestClient creates a REST API client from the base url of Home
+// Assistant, like http://192.168.1.5:8123, and a long-lived access token
+func NewRestClient(baseURL string, token string, config ConnectionConfig) (*RestClient, error) {
+	endpoint, err := newEndpoint(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RestClient{
+		endpoint:   endpoint,
+		token:      token,
+		httpClient: config.httpClient(),
+		header:     config.Header}, nil
+}
+
+// REST returns a REST API client using the url, token and connection
+// config of the client
+func (a *homeAssistantPlatform) REST() *RestClient {
+	client := &RestClient{
+		endpoint:   a.endpoint,
+		token:      a.token,
+		httpClient: a.httpClient,
+		header:     a.header,
+		location:   a.location()}
+	// A poster given when creating the client, like a fake in tests
+	if a.poster != nil && a.poster != HassHTTPPoster(a) {
+		client.poster = a.poster
+	}
+	return client
+}
+
+// Status returns the message of GET /api/, "API running." if all is well
+func (a *RestClient) Status(ctx context.Context) (string, error) {
+	var result messageData
+	if _, err := a.do(ctx, "GET", "", nil, nil, &result); err != nil {
+		return "", err
+	}
+	return result.Message, nil
+}
+
+// Config returns the configuration of Home Assistant
+func (a *RestClient) Config(ctx context.Context) (ConfigData, error) {
+	var result ConfigData
+	_, err := a.do(ctx, "GET", "config", nil, nil, &result)
+	return result, err
+}
+
+// States returns the current state of all entities
+func (a *RestClient) States(ctx context.Context) ([]HassEntity, error) {
+	var result []StateData
+	if _, err := a.do(ctx, "GET", "states", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return a.entities(result), nil
+}
+
+// State returns the current state of an entity, an *APIError with status
+// 404 is returned if it does not exist
+func (a *RestClient) State(ctx context.Context, entityID string) (HassEntity, error) {
+	var result StateData
+	if _, err := a.do(ctx, "GET", "states/"+url.PathEscape(entityID), nil, nil, &result); err != nil {
+		return HassEntity{}, err
+	}
+	return a.entity(result), nil
+}
+
+// SetState creates or updates the state of an entity and returns the state
+// Home Assistant stored
+func (a *RestClient) SetState(ctx context.Context, entityID string, state string, attributes map[string]interface{}) (SetEntityResult, error) {
+	var result StateData
+	statusCode, err := a.do(ctx, "POST", "states/"+url.PathEscape(entityID), nil,
+		SetStateData{State: state, Attributes: attributes}, &result)
+	if err != nil {
+		return SetEntityResult{}, err
+	}
+	return SetEntityResult{Entity: a.entity(result), Created: statusCode == http.StatusCreated}, nil
+}
+
+// DeleteState removes an entity from the state machine, only use it for
+// entities created through the API
+func (a *RestClient) DeleteState(ctx context.Context, entityID string) error {
+	_, err := a.do(ctx, "DELETE", "states/"+url.PathEscape(entityID), nil, nil, nil)
+	return err
+}
+
+// Services returns the available services per domain
+func (a *RestClient) Services(ctx context.Context) ([]ServiceDomain, error) {
+	var result []ServiceDomain
+	_, err := a.do(ctx, "GET", "services", nil, nil, &result)
+	return result, err
+}
+
+// Events returns the event types that has listeners
+func (a *RestClient) Events(ctx context.Context) ([]EventListener, error) {
+	var result []EventListener
+	_, err := a.do(ctx, "GET", "events", nil, nil, &result)
+	return result, err
+}
+
+// CallService calls a service and returns the entities that changed
+// while the service was running
+func (a *RestClient) CallService(ctx context.Context, domain string, service string, serviceData map[string]interface{}) ([]HassEntity, error) {
+	if serviceData == nil {
+		serviceData = map[string]interface{}{}
+	}
+	var result []StateData
+	apiPath := "services/" + url.PathEscape(domain) + "/" + url.PathEscape(service)
+	if _, err := a.do(ctx, "POST", apiPath, nil, serviceData, &result); err != nil {
+		return nil, err
+	}
+	return a.entities(result), nil
+}
+
+// FireEvent fires an event on the event bus
+func (a *RestClient) FireEvent(ctx context.Context, eventType string, eventData map[string]interface{}) error {
+	if eventData == nil {
+		eventData = map[string]interface{}{}
+	}
+	_, err := a.do(ctx, "POST", "events/"+url.PathEscape(eventType), nil, eventData, nil)
+	return err
+}
+
+// RenderTemplate renders a template like "{{ states('sun.sun') }}"
+func (a *RestClient) RenderTemplate(ctx context.Context, template string) (string, error) {
+	var result bytes.Buffer
+	_, err := a.do(ctx, "POST", "template", nil, map[string]string{"template": template}, &result)
+	return result.String(), err
+}
+
+// CheckConfig checks configuration.yaml, the config component has to be
+// loaded in Home Assistant
+func (a *RestClient) CheckConfig(ctx context.Context) (CheckConfigResult, error) {
+	var result CheckConfigResult
+	_, err := a.do(ctx, "POST", "config/core/check_config", nil, nil, &result)
+	return result, err
+}
+
+// do sends a request to the escaped api path with the query and decodes the
+// response into result, a *bytes.Buffer gets the raw body. Returns the status
+// code, an *APIError if it is not 2xx.
+func (a *RestClient) do(ctx context.Context, method string, apiPath string, query url.Values, data interface{}, result interface{}) (int, error) {
+	var body []byte
+	if data != nil {
+		var err error
+		if body, err = json.Marshal(data); err != nil {
+			return 0, err
+		}
+	}
+	statusCode, b, err := a.send(ctx, method, a.endpoint.apiURL(apiPath, query), body)
+	if err != nil {
+		return statusCode, err
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return statusCode, newAPIError(statusCode, b)
+	}
+	switch v := result.(type) {
+	case nil:
+	case *bytes.Buffer:
+		v.Write(b)
+	default:
+		if err := json.Unmarshal(b, result); err != nil {
+			return statusCode, fmt.Errorf("failed to decode %s %s: %v", method, apiPath, err)
+		}
+	}
+	return statusCode, nil
+}
+
+// send sends the request with the headers and token of the client, returns
+// the status code and body of the response. Posts go through the poster if
+// set.
+func (a *RestClient) send(ctx context.Context, method string, u string, body []byte) (int, []byte, error) {
+	if method == "POST" && a.poster != nil {
+		return a.poster.HassHTTPPostAPI(u, body)
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	setHeaders(req, a.header)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// entity converts state data from the REST API, bad timestamps are logged
+// and left as zero time
+func (a *RestClient) entity(data StateData) HassEntity {
+	new, err := newHassEntityState(data, a.location)
+	if err != nil {
+		log.Errorf("Failed to decode state of %s: %v", data.EntityId, err)
+	}
+	return *NewHassEntity(data.EntityId, data.EntityId, HassEntityState{}, new)
+}
+
+// entities converts a list of state data from the REST API
+func (a *RestClient) entities(data []StateData) []HassEntity {
+	entities := make([]HassEntity, 0, len(data))
+	for _, state := range data {
+		entities = append(entities, a.entity(state))
+	}
+	return entities
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// StatisticPeriod is the period each statistic covers
+type StatisticPeriod string
+
+// Periods of statistics_during_period
+const (
+	StatisticPeriod5Minute StatisticPeriod = "5minute"
+	StatisticPeriodHour    StatisticPeriod = "hour"
+	StatisticPeriodDay     StatisticPeriod = "day"
+	StatisticPeriodWeek    StatisticPeriod = "week"
+	StatisticPeriodMonth   StatisticPeriod = "month"
+)
+
+// StatisticType is a value of the statistics
+type StatisticType string
+
+// Types of statistic values
+const (
+	StatisticTypeMean   StatisticType = "mean"
+	StatisticTypeMin    StatisticType = "min"
+	StatisticTypeMax    StatisticType = "max"
+	StatisticTypeSum    StatisticType = "sum"
+	StatisticTypeState  StatisticType = "state"
+	StatisticTypeChange StatisticType = "change"
+)
+
+// StatisticMetadata describes a statistic of the recorder
+type StatisticMetadata struct {
+	StatisticID string `json:"statistic_id"`
+	Name        string `json:"name"`
+	// Source is "recorder" for statistics of entities, or the domain of
+	// external statistics
+	Source string `json:"source"`
+	// UnitOfMeasurement is the unit the statistic is stored in
+	UnitOfMeasurement string `json:"statistics_unit_of_measurement"`
+	// DisplayUnitOfMeasurement is the unit shown in Home Assistant
+	DisplayUnitOfMeasurement string `json:"display_unit_of_measurement"`
+	UnitClass                string `json:"unit_class"`
+	HasMean                  bool   `json:"has_mean"`
+	HasSum                   bool   `json:"has_sum"`
+}
+
+// Statistic is the values of a statistic for one period, values not
+// requested or not recorded are nil
+type Statistic struct {
+	Start     time.Time
+	End       time.Time
+	LastReset time.Time
+	Mean      *float64
+	Min       *float64
+	Max       *float64
+	Sum       *float64
+	State     *float64
+	Change    *float64
+}
+
+// HassStatistics holds the statistics of each statistic id in time order
+type HassStatistics map[string][]Statistic
+
+// statisticData is a statistic from statistics_during_period, times are
+// unix milliseconds or timestamps in older versions of Home Assistant
+type statisticData struct {
+	Start     json.RawMessage `json:"start"`
+	End       json.RawMessage `json:"end"`
+	LastReset json.RawMessage `json:"last_reset"`
+	Mean      *float64        `json:"mean"`
+	Min       *float64        `json:"min"`
+	Max       *float64        `json:"max"`
+	Sum       *float64        `json:"sum"`
+	State     *float64        `json:"state"`
+	Change    *float64        `json:"change"`
+}
+
+// statisticTime decodes a time of the statistics
+func statisticTime(data json.RawMessage, location *time.Location) (time.Time, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return time.Time{}, nil
+	}
+	if data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return time.Time{}, err
+		}
+		return parseHassTime(value, location)
+	}
+	var value float64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return time.Time{}, err
+	}
+	return compressedTime(value/1000, location), nil
+}
+
+// newStatistic converts a statistic from Home Assistant
+func newStatistic(data statisticData, location *time.Location) (Statistic, error) {
+	var err error
+	statistic := Statistic{
+		Mean:   data.Mean,
+		Min:    data.Min,
+		Max:    data.Max,
+		Sum:    data.Sum,
+		State:  data.State,
+		Change: data.Change}
+
+	if statistic.Start, err = statisticTime(data.Start, location); err != nil {
+		return statistic, fmt.Errorf("start: %v", err)
+	}
+	if statistic.End, err = statisticTime(data.End, location); err != nil {
+		return statistic, fmt.Errorf("end: %v", err)
+	}
+	if statistic.LastReset, err = statisticTime(data.LastReset, location); err != nil {
+		return statistic, fmt.Errorf("last_reset: %v", err)
+	}
+	return statistic, nil
+}
+
+// ListStatisticIDs returns the statistics the recorder has, an empty type
+// returns all, otherwise only those with mean or sum
+func (a *Recorder) ListStatisticIDs(ctx context.Context, statisticType StatisticType) ([]StatisticMetadata, error) {
+	message := map[string]interface{}{"type": "recorder/list_statistic_ids"}
+	if statisticType != "" {
+		message["statistic_type"] = statisticType
+	}
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	var metadata []StatisticMetadata
+	if err := result.decodeResult(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode statistic ids: %v", err)
+	}
+	return metadata, nil
+}
+
+// StatisticsMetadata returns the metadata of the statistics, no ids
+// returns all
+func (a *Recorder) StatisticsMetadata(ctx context.Context, statisticIDs []string) ([]StatisticMetadata, error) {
+	message := map[string]interface{}{"type": "recorder/get_statistics_metadata"}
+	if len(statisticIDs) > 0 {
+		message["statistic_ids"] = statisticIDs
+	}
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	var metadata []StatisticMetadata
+	if err := result.decodeResult(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode statistics metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// Statistics returns the statistics between start and end for each period,
+// a zero end means until now. No types returns all types.
+func (a *Recorder) Statistics(ctx context.Context, statisticIDs []string, start, end time.Time, period StatisticPeriod, types []StatisticType) (HassStatistics, error) {
+	switch period {
+	case StatisticPeriod5Minute, StatisticPeriodHour, StatisticPeriodDay, StatisticPeriodWeek, StatisticPeriodMonth:
+	default:
+		return nil, fmt.Errorf("unknown statistic period %q", period)
+	}
+	message := map[string]interface{}{
+		"type":          "recorder/statistics_during_period",
+		"start_time":    start.UTC().Format(time.RFC3339Nano),
+		"statistic_ids": statisticIDs,
+		"period":        period}
+	if !end.IsZero() {
+		message["end_time"] = end.UTC().Format(time.RFC3339Nano)
+	}
+	if len(types) > 0 {
+		message["types"] = types
+	}
+	result, err := a.hass.sendCommand(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string][]statisticData
+	if err := result.decodeResult(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode statistics: %v", err)
+	}
+
+	location := a.hass.location()
+	statistics := make(HassStatistics, len(data))
+	for statisticID, series := range data {
+		converted := make([]Statistic, 0, len(series))
+		for _, item := range series {
+			statistic, err := newStatistic(item, location)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode statistics of %s: %v", statisticID, err)
+			}
+			converted = append(converted, statistic)
+		}
+		statistics[statisticID] = converted
+	}
+	return statistics, nil
+}
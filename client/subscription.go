@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// Subscription is a command streaming events from Home Assistant. It ends
+// when unsubscribed or when the connection is lost.
+type Subscription struct {
+	id   int64
+	hass *homeAssistantPlatform
+	done chan struct{}
+}
+
+// Done is closed when the subscription has ended
+func (a *Subscription) Done() <-chan struct{} {
+	return a.done
+}
+
+// Unsubscribe stops the subscription
+func (a *Subscription) Unsubscribe(ctx context.Context) error {
+	a.hass.unsubscribe(a.id)
+	_, err := a.hass.sendCommand(ctx, map[string]interface{}{
+		"type":         "unsubscribe_events",
+		"subscription": a.id})
+	return err
+}
+
+// subscription delivers the events of a subscribed command in the order
+// they arrive from Home Assistant. Events are queued without limit so a
+// slow handler never blocks reading from Home Assistant.
+type subscription struct {
+	queue []Result
+	m     sync.Mutex
+	// Signals that events are queued
+	queued chan struct{}
+	done   chan struct{}
+}
+
+// push queues the event for the handler
+func (a *subscription) push(event Result) {
+	a.m.Lock()
+	a.queue = append(a.queue, event)
+	a.m.Unlock()
+	select {
+	case a.queued <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the queued events and empties the queue
+func (a *subscription) pop() []Result {
+	a.m.Lock()
+	defer a.m.Unlock()
+	events := a.queue
+	a.queue = nil
+	return events
+}
+
+// subscribe registers handle to receive events for the command with given
+// id. Events are handled one at the time in a separate go routine.
+func (a *homeAssistantPlatform) subscribe(id int64, handle func(Result)) *subscription {
+	sub := &subscription{
+		queued: make(chan struct{}, 1),
+		done:   make(chan struct{})}
+
+	a.subscriptionsMutex.Lock()
+	a.subscriptions[id] = sub
+	a.subscriptionsMutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-sub.queued:
+				for _, event := range sub.pop() {
+					handle(event)
+				}
+			case <-sub.done:
+				return
+			case <-a.context.Done():
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+// subscribeCommand sends a command that streams events, handle gets the
+// events in the order they arrive
+func (a *homeAssistantPlatform) subscribeCommand(ctx context.Context, message map[string]interface{}, handle func(Result)) (*Subscription, error) {
+	id := a.nextID()
+	message["id"] = id
+	// Events may arrive right after the result
+	sub := a.subscribe(id, handle)
+	if _, err := a.sendCommand(ctx, message); err != nil {
+		a.unsubscribe(id)
+		return nil, err
+	}
+	return &Subscription{id: id, hass: a, done: sub.done}, nil
+}
+
+// unsubscribe stops delivery of events for the subscription with given id
+func (a *homeAssistantPlatform) unsubscribe(id int64) {
+	a.subscriptionsMutex.Lock()
+	defer a.subscriptionsMutex.Unlock()
+
+	if sub, ok := a.subscriptions[id]; ok {
+		close(sub.done)
+		delete(a.subscriptions, id)
+	}
+}
+
+// clearSubscriptions stops all subscriptions, used when the connection is
+// lost since Home Assistant forgets subscriptions on disconnect
+func (a *homeAssistantPlatform) clearSubscriptions() {
+	a.subscriptionsMutex.Lock()
+	defer a.subscriptionsMutex.Unlock()
+
+	for id, sub := range a.subscriptions {
+		close(sub.done)
+		delete(a.subscriptions, id)
+	}
+}
+
+// dispatchEvent queues the event for its subscription without blocking,
+// returns false if the message is not an event for a subscription
+func (a *homeAssistantPlatform) dispatchEvent(message Result) bool {
+	if message.MessageType != "event" {
+		return false
+	}
+	a.subscriptionsMutex.Lock()
+	sub, ok := a.subscriptions[message.Id]
+	a.subscriptionsMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	sub.push(message)
+	return true
+}
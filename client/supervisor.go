@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/url"
+	"os"
+)
+
+const (
+	// Host of the Supervisor inside add-ons
+	supervisorHost = "supervisor"
+	// Environment variable the Supervisor uses for the add-on token
+	supervisorTokenEnv = "SUPERVISOR_TOKEN"
+	// Environment variable used for the token before Supervisor was renamed
+	legacySupervisorTokenEnv = "HASSIO_TOKEN"
+)
+
+// Used to mock the environment in tests
+var getenv = os.Getenv
+
+// supervisorToken returns the token the Supervisor provides to add-ons
+func supervisorToken() string {
+	if token := getenv(supervisorTokenEnv); token != "" {
+		return token
+	}
+	return getenv(legacySupervisorTokenEnv)
+}
+
+// InAddon returns true when running as a Home Assistant add-on
+func InAddon() bool {
+	return supervisorToken() != ""
+}
+
+// supervisorEndpoint returns the endpoint of Home Assistant Core proxied
+// through the Supervisor
+func supervisorEndpoint() endpoint {
+	base := &url.URL{Scheme: "http", Host: supervisorHost}
+	endpoint, _ := newProxiedEndpoint(base, "/core/websocket", "/core/api")
+	return endpoint
+}
+
+// StartAddon starts the Home Assistant client as an add-on connecting
+// through the Supervisor using the token it provides
+func (a *homeAssistantPlatform) StartAddon() bool {
+	if !InAddon() {
+		log.Errorf("Not running as an add-on, %s is missing", supervisorTokenEnv)
+		return false
+	}
+	log.Infoln("Running as add-on, connecting through the Supervisor")
+	return a.start(supervisorEndpoint(), supervisorToken())
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	ws "github.com/helto4real/go-hassclient/internal/wsocket"
+	"github.com/helto4real/go-hassclient/transport"
+)
+
+// Time allowed to write a message to a custom transport
+var transportWriteTimeout = 10 * time.Second
+
+// WithTransport connects to Home Assistant using the dialer instead of the
+// built in websocket client. Only the REST API uses ConnectionConfig, and
+// CompressionStats does not count the traffic. Use transport.WebsocketDialer
+// to configure the websocket. Start fails if combined with
+// WithMaxMessageSize or WithCompression.
+func WithTransport(dialer transport.Dialer) Option {
+	return func(a *homeAssistantPlatform) {
+		a.dialer = dialer
+	}
+}
+
+// NewHassClientConnection creates a client using an already open
+// connection, like one end of transport.Pipe when faking Home Assistant in
+// tests. A nil poster posts states through the REST API.
+func NewHassClientConnection(conn transport.Conn, poster HassHTTPPoster, options ...Option) HomeAssistant {
+	client := newHassClient()
+	client.setConnection(newTransportConnection(conn))
+	client.poster = poster
+	for _, option := range options {
+		option(client)
+	}
+	return client
+}
+
+// checkTransport returns an error if websocket options are combined with a
+// custom transport that would ignore them
+func (a *homeAssistantPlatform) checkTransport() error {
+	if a.dialer == nil {
+		return nil
+	}
+	if a.wsOptions.MaxMessageSize != 0 {
+		return errors.New("WithMaxMessageSize is not supported with WithTransport, use transport.WebsocketOptions")
+	}
+	if a.wsOptions.EnableCompression {
+		return errors.New("WithCompression is not supported with WithTransport, use transport.WebsocketOptions")
+	}
+	return nil
+}
+
+// transportConnection adapts a transport.Conn to the connection used by the
+// client
+type transportConnection struct {
+	conn       transport.Conn
+	context    context.Context
+	cancelFunc context.CancelFunc
+	m          sync.Mutex
+	isClosed   bool
+}
+
+func newTransportConnection(conn transport.Conn) *transportConnection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transportConnection{conn: conn, context: ctx, cancelFunc: cancel}
+}
+
+// dialTransport connects using the custom dialer, returns nil on failure
+func (a *homeAssistantPlatform) dialTransport(url string) ws.Connected {
+	conn, err := a.dialer.Dial(a.context, url)
+	if err != nil {
+		log.Errorf("dial: %v", err)
+		return nil
+	}
+	return newTransportConnection(conn)
+}
+
+func (a *transportConnection) Close() {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.isClosed {
+		return
+	}
+	a.isClosed = true
+	a.cancelFunc()
+	if err := a.conn.Close(); err != nil {
+		log.Errorf("Failed to close transport: %v", err)
+	}
+}
+
+func (a *transportConnection) IsClosed() bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.isClosed
+}
+
+func (a *transportConnection) SendMap(ctx context.Context, message map[string]interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return a.write(ctx, data)
+}
+
+func (a *transportConnection) SendString(ctx context.Context, message string) error {
+	return a.write(ctx, []byte(message))
+}
+
+// QueueDepth is always zero since messages are written directly
+func (a *transportConnection) QueueDepth() int {
+	return 0
+}
+
+func (a *transportConnection) write(ctx context.Context, message []byte) error {
+	if a.IsClosed() {
+		return transport.ErrClosed
+	}
+	ctx, cancel := context.WithTimeout(ctx, transportWriteTimeout)
+	defer cancel()
+	// Closing the connection cancels ongoing writes
+	go func() {
+		select {
+		case <-a.context.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return a.conn.WriteMessage(ctx, message)
+}
+
+func (a *transportConnection) Read() ([]byte, bool) {
+	message, err := a.conn.ReadMessage(a.context)
+	if err != nil {
+		if !a.IsClosed() {
+			log.Errorf("Failed to read from transport: %v", err)
+		}
+		a.Close()
+		return nil, false
+	}
+	return message, true
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Time allowed to remove the virtual entities when stopping
+var virtualEntityRemoveTimeout = 5 * time.Second
+
+// ErrPublishOnConnect is returned when a virtual entity is set while not
+// connected, it is published once connected
+var ErrPublishOnConnect = errors.New("not connected to Home Assistant, will publish on connect")
+
+// VirtualEntities keeps entities owned by the daemon published in Home
+// Assistant. States set through the API are lost when Home Assistant
+// restarts, so they are published again after every reconnect and
+// homeassistant_started event, and when someone else changes their state.
+type VirtualEntities struct {
+	hass         *homeAssistantPlatform
+	entities     map[string]HassEntityState
+	removeOnStop bool
+	m            sync.Mutex
+}
+
+func newVirtualEntities(hass *homeAssistantPlatform) *VirtualEntities {
+	return &VirtualEntities{
+		hass:     hass,
+		entities: make(map[string]HassEntityState)}
+}
+
+// WithRemoveVirtualEntitiesOnStop deletes the virtual entities from Home
+// Assistant when the client is stopped
+func WithRemoveVirtualEntitiesOnStop() Option {
+	return func(a *homeAssistantPlatform) {
+		a.virtualEntities.removeOnStop = true
+	}
+}
+
+// VirtualEntities returns the manager of the entities owned by the daemon
+func (a *homeAssistantPlatform) VirtualEntities() *VirtualEntities {
+	return a.virtualEntities
+}
+
+// Set declares the entity or updates its state and publishes it. If not
+// connected ErrPublishOnConnect is returned and it is published once
+// connected.
+func (a *VirtualEntities) Set(entityID string, state string, attributes map[string]interface{}) (SetEntityResult, error) {
+	new := HassEntityState{State: state, Attributes: attributes}
+	a.m.Lock()
+	a.entities[entityID] = new
+	a.m.Unlock()
+
+	if !a.hass.isReady() {
+		return SetEntityResult{}, ErrPublishOnConnect
+	}
+	return a.hass.setEntity(&HassEntity{ID: entityID, Name: entityID, New: new})
+}
+
+// Get returns the declared state of the entity
+func (a *VirtualEntities) Get(entityID string) (HassEntityState, bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	state, ok := a.entities[entityID]
+	return state, ok
+}
+
+// Remove stops managing the entity and deletes it from Home Assistant
+func (a *VirtualEntities) Remove(ctx context.Context, entityID string) error {
+	a.m.Lock()
+	delete(a.entities, entityID)
+	a.m.Unlock()
+	return a.hass.REST().DeleteState(ctx, entityID)
+}
+
+// publishAll publishes all virtual entities, used when Home Assistant may
+// have forgotten them
+func (a *VirtualEntities) publishAll() {
+	a.m.Lock()
+	entities := make(map[string]HassEntityState, len(a.entities))
+	for entityID, state := range a.entities {
+		entities[entityID] = state
+	}
+	a.m.Unlock()
+
+	for entityID, state := range entities {
+		a.publish(entityID, state)
+	}
+}
+
+// changed publishes the virtual entity again if its state or attributes
+// in Home Assistant differs from the declared ones
+func (a *VirtualEntities) changed(entityID string, state HassEntityState) {
+	a.m.Lock()
+	declared, ok := a.entities[entityID]
+	a.m.Unlock()
+	if !ok || (declared.State == state.State && sameAttributes(declared.Attributes, state.Attributes)) {
+		return
+	}
+	log.Debugf("Virtual entity %s changed to %q, publishing %q", entityID, state.State, declared.State)
+	go a.publish(entityID, declared)
+}
+
+// publish sets the state of the virtual entity in Home Assistant
+func (a *VirtualEntities) publish(entityID string, state HassEntityState) {
+	if _, err := a.hass.setEntity(&HassEntity{ID: entityID, Name: entityID, New: state}); err != nil {
+		log.Errorf("Failed to publish virtual entity %s: %v", entityID, err)
+	}
+}
+
+// removeAll deletes the virtual entities from Home Assistant
+func (a *VirtualEntities) removeAll() {
+	a.m.Lock()
+	entityIDs := make([]string, 0, len(a.entities))
+	for entityID := range a.entities {
+		entityIDs = append(entityIDs, entityID)
+	}
+	a.m.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), virtualEntityRemoveTimeout)
+	defer cancel()
+	rest := a.hass.REST()
+	for _, entityID := range entityIDs {
+		if err := rest.DeleteState(ctx, entityID); err != nil {
+			log.Errorf("Failed to remove virtual entity %s: %v", entityID, err)
+		}
+	}
+}
+
+// sameAttributes compares the attributes as json, since numbers from Home
+// Assistant are float64. Nil and empty attributes are the same.
+func sameAttributes(declared, actual map[string]interface{}) bool {
+	if len(declared) == 0 || len(actual) == 0 {
+		return len(declared) == len(actual)
+	}
+	declaredJSON, err := json.Marshal(declared)
+	if err != nil {
+		return false
+	}
+	actualJSON, err := json.Marshal(actual)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(declaredJSON, actualJSON)
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// touch records that Home Assistant is alive
+func (a *homeAssistantPlatform) touch() {
+	atomic.StoreInt64(&a.lastMessage, time.Now().UnixNano())
+}
+
+// sinceLastMessage returns the time since Home Assistant was last heard from
+func (a *homeAssistantPlatform) sinceLastMessage() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.lastMessage)))
+}
+
+// Ping sends a ping command to Home Assistant and waits for the pong.
+// Returns ErrNotConnected until authenticated, Home Assistant closes the
+// connection on anything but auth before that.
+func (a *homeAssistantPlatform) Ping() (time.Duration, error) {
+	return a.ping(a.context)
+}
+
+// ping sends a ping command and waits for the pong until ctx is done
+func (a *homeAssistantPlatform) ping(ctx context.Context) (time.Duration, error) {
+	if atomic.LoadInt32(&a.authenticated) == 0 {
+		return 0, ErrNotConnected
+	}
+	start := time.Now()
+	s := map[string]interface{}{
+		"type": "ping"}
+
+	if _, err := a.sendCommand(ctx, s); err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	atomic.StoreInt64(&a.latency, int64(latency))
+	return latency, nil
+}
+
+// Latency returns the round-trip time of the last successful ping
+func (a *homeAssistantPlatform) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.latency))
+}
+
+// watchdog pings Home Assistant and closes the connection if nothing has
+// been heard from it within the timeout. Closing makes Start reconnect.
+func (a *homeAssistantPlatform) watchdog() {
+	ticker := time.NewTicker(a.watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.context.Done():
+			return
+		case <-ticker.C:
+			if since := a.sinceLastMessage(); since > a.watchdogTimeout {
+				log.Warnf("No message from Home Assistant in %v, reconnecting...", since)
+				// Give the new connection a full timeout
+				a.touch()
+				if client := a.connection(); client != nil {
+					client.Close()
+				}
+				continue
+			}
+			// Ping is only allowed after authentication. Skip the ping if the
+			// last one is still waiting for its pong.
+			if atomic.LoadInt32(&a.authenticated) == 1 && atomic.CompareAndSwapInt32(&a.pinging, 0, 1) {
+				go a.watchdogPing()
+			}
+		}
+	}
+}
+
+// watchdogPing pings Home Assistant, the pong has to arrive before the next
+// tick of the watchdog
+func (a *homeAssistantPlatform) watchdogPing() {
+	defer atomic.StoreInt32(&a.pinging, 0)
+	ctx, cancel := context.WithTimeout(a.context, a.watchdogInterval)
+	defer cancel()
+	if _, err := a.ping(ctx); err != nil {
+		log.Warnf("Ping to Home Assistant failed: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package wsocket
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Stats counts the bytes of messages and the bytes sent on the wire, with
+// compression the wire bytes are less than the message bytes. Use atomic
+// loads to read the counters.
+type Stats struct {
+	MessageBytesRead    int64
+	MessageBytesWritten int64
+	WireBytesRead       int64
+	WireBytesWritten    int64
+}
+
+// countingConn counts the bytes read and written on the wire
+type countingConn struct {
+	net.Conn
+	stats *Stats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.stats.WireBytesRead, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.stats.WireBytesWritten, int64(n))
+	return n, err
+}
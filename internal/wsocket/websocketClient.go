@@ -2,9 +2,14 @@ package wsocket
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,12 +20,21 @@ var log *logrus.Entry
 
 type Connected interface {
 	Close()
-	SendMap(message map[string]interface{})
-	SendString(message string)
+	// SendMap queues the message as json, blocks while the queue is full
+	// until the context is done
+	SendMap(ctx context.Context, message map[string]interface{}) error
+	// SendString queues the message, blocks while the queue is full until
+	// the context is done
+	SendString(ctx context.Context, message string) error
 	Read() ([]byte, bool)
 	IsClosed() bool
+	// QueueDepth returns the number of messages waiting to be written
+	QueueDepth() int
 }
 
+// ErrClosed is returned when sending on a closed connection
+var ErrClosed = errors.New("websocket connection closed")
+
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
@@ -28,13 +42,88 @@ const (
 	// Time allowed to read the next pong message from the peer.
 	pongWait = 60 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	// PingPeriod is how often to ping peer. Must be less than pongWait.
+	PingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 3448576
+	// DefaultMaxMessageSize is the maximum message size allowed from peer
+	// if not set in Options
+	DefaultMaxMessageSize = 3448576
 )
 
+// Options configures the websocket connection
+type Options struct {
+	// MaxMessageSize is the maximum message size in bytes allowed from
+	// peer, zero uses the default
+	MaxMessageSize int64
+	// TLSConfig used for wss connections, nil uses the default
+	TLSConfig *tls.Config
+	// Proxy returns the proxy for the request, nil uses the environment
+	Proxy func(*http.Request) (*url.URL, error)
+	// Header is sent with the handshake request
+	Header http.Header
+	// HandshakeTimeout for the websocket handshake, zero uses the default
+	HandshakeTimeout time.Duration
+	// EnableCompression negotiates permessage-deflate with the peer
+	EnableCompression bool
+	// Stats counts the traffic if set, can be shared between connections
+	Stats *Stats
+}
+
+// dialer makes a websocket dialer from the options
+func (a Options) dialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if a.TLSConfig != nil {
+		dialer.TLSClientConfig = a.TLSConfig
+	}
+	if a.Proxy != nil {
+		dialer.Proxy = a.Proxy
+	}
+	if a.HandshakeTimeout > 0 {
+		dialer.HandshakeTimeout = a.HandshakeTimeout
+	}
+	dialer.EnableCompression = a.EnableCompression
+	if a.Stats != nil {
+		stats := a.Stats
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, stats: stats}, nil
+		}
+	}
+	return &dialer
+}
+
+// Dial connects a websocket to the url using the options. The read limit is
+// set and pongs from peer extend the read deadline.
+func Dial(ctx context.Context, u string, options Options) (*websocket.Conn, error) {
+	conn, _, err := options.dialer().DialContext(ctx, u, options.Header)
+	if err != nil {
+		return nil, err
+	}
+	maxMessageSize := options.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	conn.SetReadLimit(maxMessageSize)
+	ExtendReadDeadline(conn)
+	conn.SetPongHandler(func(string) error { return ExtendReadDeadline(conn) })
+	return conn, nil
+}
+
+// ExtendReadDeadline gives peer until the next pong to send a message
+func ExtendReadDeadline(conn *websocket.Conn) error {
+	return conn.SetReadDeadline(time.Now().Add(pongWait))
+}
+
+// Ping sends a ping to peer, do this every PingPeriod to keep the
+// connection alive. Must not run at the same time as other writes.
+func Ping(conn *websocket.Conn) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.PingMessage, nil)
+}
+
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
@@ -54,11 +143,15 @@ type websocketClient struct {
 	syncReader sync.WaitGroup
 	// Used to thread safe the close method
 	m sync.Mutex
+	// Closed when the client is closing, stops senders and pumps
+	done chan struct{}
 
 	context    context.Context
 	cancelFunc context.CancelFunc
 
 	isClosed bool
+
+	stats *Stats
 }
 
 // readPump ensures only one reader per connection.
@@ -70,9 +163,6 @@ func (c *websocketClient) readPump() {
 		log.Traceln("Close ws readpump")
 
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
 		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -83,13 +173,16 @@ func (c *websocketClient) readPump() {
 			}
 			return
 		}
-		if c.isClosed {
-			return
-		}
-
 		if messageType == websocket.TextMessage {
 			// ioutil.WriteFile("test.json", message, 0)
-			c.receiveChannel <- message
+			if c.stats != nil {
+				atomic.AddInt64(&c.stats.MessageBytesRead, int64(len(message)))
+			}
+			select {
+			case c.receiveChannel <- message:
+			case <-c.done:
+				return
+			}
 		}
 	}
 }
@@ -108,14 +201,12 @@ func (c *websocketClient) Close() {
 	//  Wait for the routines to stop
 	c.m.Unlock()
 
-	// The sender
-	close(c.sendChannel)
+	// Stops senders and the writer
+	close(c.done)
 	c.syncWriter.Wait()
 
 	c.cancelFunc()
 
-	close(c.receiveChannel)
-
 	c.conn.Close()
 	c.syncReader.Wait()
 
@@ -130,31 +221,43 @@ func (c *websocketClient) IsClosed() bool {
 	return c.isClosed
 }
 
-func (c *websocketClient) SendMap(message map[string]interface{}) {
-	c.m.Lock()
-	defer c.m.Unlock()
-	if c.isClosed {
-		return
-	}
+// SendMap queues the message as json for the writer
+func (c *websocketClient) SendMap(ctx context.Context, message map[string]interface{}) error {
 	jsonString, err := json.Marshal(message)
 	if err != nil {
-		return
+		return err
 	}
-
-	c.sendChannel <- jsonString
-
+	return c.send(ctx, jsonString)
 }
 
-func (c *websocketClient) SendString(message string) {
-	c.m.Lock()
-	defer c.m.Unlock()
+// SendString queues the message for the writer
+func (c *websocketClient) SendString(ctx context.Context, message string) error {
+	return c.send(ctx, []byte(message))
+}
 
-	if c.isClosed {
-		return
+// send queues the message, blocks while the queue is full until the context
+// is done or the connection closes
+func (c *websocketClient) send(ctx context.Context, message []byte) error {
+	// Make sure a closed connection never accepts messages
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
 	}
 
-	c.sendChannel <- []byte(message)
+	select {
+	case c.sendChannel <- message:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+// QueueDepth returns the number of messages waiting to be written
+func (c *websocketClient) QueueDepth() int {
+	return len(c.sendChannel)
 }
 
 // Read the next message
@@ -176,7 +279,7 @@ func (c *websocketClient) Read() ([]byte, bool) {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *websocketClient) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.syncWriter.Done()
@@ -185,37 +288,40 @@ func (c *websocketClient) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.sendChannel:
-			if c.isClosed {
-				return
-			}
+		case <-c.done:
+			// The client is closing
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-c.sendChannel:
 			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				log.Errorf("Failed to write message: %v", err)
 				return
 			}
 
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 			// var w io.WriteCloser
 			if w, err := c.conn.NextWriter(websocket.TextMessage); err != nil {
+				log.Errorf("Failed to write message: %v", err)
 				return
 			} else {
 				if _, err := w.Write(message); err != nil {
+					log.Errorf("Failed to write message: %v", err)
 					return
 				}
 
 				log.Tracef("msg->%s", string(message))
+				if c.stats != nil {
+					atomic.AddInt64(&c.stats.MessageBytesWritten, int64(len(message)))
+				}
 
 				if err := w.Close(); err != nil {
+					log.Errorf("Failed to write message: %v", err)
 					return
 				}
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := Ping(c.conn); err != nil {
 				return
 			}
 		}
@@ -224,13 +330,22 @@ func (c *websocketClient) writePump() {
 
 // ConnectWS connects to Web Socket
 func ConnectWS(ip string, path string, ssl bool) Connected {
+	return ConnectWSWithOptions(ip, path, ssl, Options{})
+}
+
+// ConnectWSWithOptions connects to Web Socket using provided options
+func ConnectWSWithOptions(ip string, path string, ssl bool, options Options) Connected {
 	var scheme = "ws"
 	if ssl == true {
 		scheme = "wss"
 	}
 	u := url.URL{Scheme: scheme, Host: ip, Path: path}
+	return ConnectURL(u.String(), options)
+}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+// ConnectURL connects to Web Socket at the url, like ws://host:8123/api/websocket
+func ConnectURL(u string, options Options) Connected {
+	c, err := Dial(context.Background(), u, options)
 	if err != nil {
 		log.Error("dial:", err)
 		return nil
@@ -239,7 +354,8 @@ func ConnectWS(ip string, path string, ssl bool) Connected {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &websocketClient{conn: c, sendChannel: make(chan []byte, 256), receiveChannel: make(chan []byte, 2),
-		isClosed: false, context: ctx, cancelFunc: cancel}
+		isClosed: false, context: ctx, cancelFunc: cancel,
+		done: make(chan struct{}), stats: options.Stats}
 
 	// Do write and read operations in own go routines
 	client.syncWriter.Add(1)
@@ -2,11 +2,16 @@ package wsocket_test
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -51,7 +56,7 @@ func TestIntegrationWebSocket(t *testing.T) {
 			wClient := ws.ConnectWS(fmt.Sprintf("127.0.0.1:%v", port), "/ws", false)
 			defer wClient.Close()
 
-			wClient.SendString("Hello world!")
+			wClient.SendString(context.Background(), "Hello world!")
 			result, _ := wClient.Read()
 			h.Equals(t, string(result), "Hello world!")
 		})
@@ -60,8 +65,8 @@ func TestIntegrationWebSocket(t *testing.T) {
 		func(*testing.T) {
 			wClient := ws.ConnectWS(fmt.Sprintf("127.0.0.1:%v", port), "/ws", false)
 			defer wClient.Close()
-			wClient.SendString("Hello world!")
-			wClient.SendString("Hello world again!")
+			wClient.SendString(context.Background(), "Hello world!")
+			wClient.SendString(context.Background(), "Hello world again!")
 			result, _ := wClient.Read()
 			h.Equals(t, "Hello world!", string(result))
 			result, _ = wClient.Read()
@@ -72,7 +77,7 @@ func TestIntegrationWebSocket(t *testing.T) {
 		func(*testing.T) {
 			wClient := ws.ConnectWS(fmt.Sprintf("127.0.0.1:%v", port), "/ws", false)
 			defer wClient.Close()
-			wClient.SendMap(map[string]interface{}{
+			wClient.SendMap(context.Background(), map[string]interface{}{
 				"test":    "hello",
 				"integer": 100})
 			result, _ := wClient.Read()
@@ -90,7 +95,7 @@ func TestIntegrationWebSocket(t *testing.T) {
 	t.Run("TestClientGracefulDisconnect",
 		func(*testing.T) {
 			wClient := ws.ConnectWS(fmt.Sprintf("127.0.0.1:%v", port), "/ws", false)
-			go wClient.SendString("close")
+			go wClient.SendString(context.Background(), "close")
 
 			time.Sleep(time.Second * 1)
 			_, ok := wClient.Read()
@@ -112,6 +117,80 @@ func TestIntegrationWebSocket(t *testing.T) {
 		})
 }
 
+func TestConnectWSWithOptions(t *testing.T) {
+	var header string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Custom")
+		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+		_, message, err := wsConn.ReadMessage()
+		if err == nil {
+			wsConn.WriteMessage(websocket.TextMessage, message)
+		}
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	wClient := ws.ConnectWSWithOptions(host, "/ws", true, ws.Options{
+		TLSConfig: &tls.Config{RootCAs: pool},
+		Header:    http.Header{"X-Custom": []string{"custom"}},
+	})
+	h.NotEquals(t, nil, wClient)
+	h.Equals(t, "custom", header)
+
+	h.Ok(t, wClient.SendString(context.Background(), "Hello world!"))
+	result, _ := wClient.Read()
+	h.Equals(t, "Hello world!", string(result))
+
+	wClient.Close()
+	h.Equals(t, ws.ErrClosed, wClient.SendString(context.Background(), "Hello world!"))
+	h.Equals(t, 0, wClient.QueueDepth())
+
+	// Not trusting the server certificate fails
+	h.Equals(t, nil, ws.ConnectWS(host, "/ws", true))
+}
+
+func TestCompression(t *testing.T) {
+	compressUpgrader := websocket.Upgrader{EnableCompression: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := compressUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+		wsConn.EnableWriteCompression(true)
+		_, message, err := wsConn.ReadMessage()
+		if err == nil {
+			wsConn.WriteMessage(websocket.TextMessage, message)
+		}
+	}))
+	defer server.Close()
+
+	stats := &ws.Stats{}
+	wClient := ws.ConnectWSWithOptions(strings.TrimPrefix(server.URL, "http://"), "/ws", false, ws.Options{
+		EnableCompression: true,
+		Stats:             stats,
+	})
+	h.NotEquals(t, nil, wClient)
+	defer wClient.Close()
+
+	message := strings.Repeat(`{"entity_id": "light.kitchen", "state": "on"},`, 1000)
+	h.Ok(t, wClient.SendString(context.Background(), message))
+	result, _ := wClient.Read()
+	h.Equals(t, message, string(result))
+
+	h.Equals(t, int64(len(message)), atomic.LoadInt64(&stats.MessageBytesRead))
+	h.Equals(t, int64(len(message)), atomic.LoadInt64(&stats.MessageBytesWritten))
+	h.Equals(t, true, atomic.LoadInt64(&stats.WireBytesRead) < int64(len(message)/10))
+}
+
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
@@ -0,0 +1,104 @@
+// Package transport defines how the Home Assistant client exchanges
+// messages with Home Assistant. The default transport is a websocket, use
+// your own Dialer to connect through other means like an in-memory pipe,
+// a Unix socket or an SSH tunnel.
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned when reading or writing a closed connection
+var ErrClosed = errors.New("transport: connection closed")
+
+// Conn is a message based connection to the Home Assistant websocket API.
+// Every message is a complete JSON document.
+type Conn interface {
+	// ReadMessage blocks until the next message is received, the
+	// connection is closed or the context is done
+	ReadMessage(ctx context.Context) ([]byte, error)
+	// WriteMessage sends a message, it blocks until the message is
+	// written, the connection is closed or the context is done
+	WriteMessage(ctx context.Context, message []byte) error
+	// Close the connection, pending reads and writes returns ErrClosed
+	Close() error
+}
+
+// Dialer connects to Home Assistant
+type Dialer interface {
+	// Dial connects to the websocket API at given url
+	Dial(ctx context.Context, url string) (Conn, error)
+}
+
+// DialerFunc makes an ordinary function a Dialer
+type DialerFunc func(ctx context.Context, url string) (Conn, error)
+
+// Dial calls f(ctx, url)
+func (f DialerFunc) Dial(ctx context.Context, url string) (Conn, error) {
+	return f(ctx, url)
+}
+
+// pipeConn is one end of an in-memory connection
+type pipeConn struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+}
+
+// Pipe returns both ends of an in-memory connection, messages written to
+// one end are read from the other. Closing one end closes both. Useful for
+// faking Home Assistant in tests.
+func Pipe() (Conn, Conn) {
+	first := make(chan []byte, 16)
+	second := make(chan []byte, 16)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+
+	return &pipeConn{in: first, out: second, closed: closed, once: once},
+		&pipeConn{in: second, out: first, closed: closed, once: once}
+}
+
+func (a *pipeConn) ReadMessage(ctx context.Context) ([]byte, error) {
+	// Prefer closed so reads after close are predictable
+	select {
+	case <-a.closed:
+		return nil, ErrClosed
+	default:
+	}
+	select {
+	case message := <-a.in:
+		return message, nil
+	case <-a.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (a *pipeConn) WriteMessage(ctx context.Context, message []byte) error {
+	// The caller may reuse the buffer
+	copied := make([]byte, len(message))
+	copy(copied, message)
+
+	select {
+	case <-a.closed:
+		return ErrClosed
+	default:
+	}
+	select {
+	case a.out <- copied:
+		return nil
+	case <-a.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *pipeConn) Close() error {
+	a.once.Do(func() { close(a.closed) })
+	return nil
+}
@@ -0,0 +1,106 @@
+package transport_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	h "github.com/helto4real/go-hassclient/internal/test"
+	"github.com/helto4real/go-hassclient/transport"
+)
+
+func TestPipe(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ReadWrite",
+		func(*testing.T) {
+			first, second := transport.Pipe()
+			defer first.Close()
+
+			h.Ok(t, first.WriteMessage(ctx, []byte("Hello world!")))
+			h.Ok(t, second.WriteMessage(ctx, []byte("Hello back!")))
+
+			message, err := second.ReadMessage(ctx)
+			h.Ok(t, err)
+			h.Equals(t, "Hello world!", string(message))
+			message, err = first.ReadMessage(ctx)
+			h.Ok(t, err)
+			h.Equals(t, "Hello back!", string(message))
+		})
+
+	t.Run("Close",
+		func(*testing.T) {
+			first, second := transport.Pipe()
+			h.Ok(t, second.Close())
+
+			_, err := first.ReadMessage(ctx)
+			h.Equals(t, transport.ErrClosed, err)
+			err = first.WriteMessage(ctx, []byte("Hello world!"))
+			h.Equals(t, transport.ErrClosed, err)
+		})
+
+	t.Run("ContextDone",
+		func(*testing.T) {
+			first, _ := transport.Pipe()
+			defer first.Close()
+
+			timeout, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+			defer cancel()
+			_, err := first.ReadMessage(timeout)
+			h.Equals(t, context.DeadlineExceeded, err)
+		})
+}
+
+func TestWebsocketDialer(t *testing.T) {
+	ctx := context.Background()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Echo the messages back
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, message)
+		}
+	}))
+	defer server.Close()
+
+	dialer := transport.WebsocketDialer(transport.WebsocketOptions{MaxMessageSize: 32})
+	conn, err := dialer.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"))
+	h.Ok(t, err)
+
+	t.Run("ReadWrite",
+		func(*testing.T) {
+			h.Ok(t, conn.WriteMessage(ctx, []byte("Hello world!")))
+			message, err := conn.ReadMessage(ctx)
+			h.Ok(t, err)
+			h.Equals(t, "Hello world!", string(message))
+		})
+
+	t.Run("ContextDone",
+		func(*testing.T) {
+			timeout, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+			defer cancel()
+			_, err := conn.ReadMessage(timeout)
+			h.Equals(t, context.DeadlineExceeded, err)
+		})
+
+	t.Run("Close",
+		func(*testing.T) {
+			h.Ok(t, conn.Close())
+			_, err := conn.ReadMessage(ctx)
+			h.Equals(t, transport.ErrClosed, err)
+			err = conn.WriteMessage(ctx, []byte("Hello world!"))
+			h.Equals(t, transport.ErrClosed, err)
+		})
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	ws "github.com/helto4real/go-hassclient/internal/wsocket"
+)
+
+// DefaultMaxMessageSize is the largest message read from Home Assistant if
+// not set in WebsocketOptions
+const DefaultMaxMessageSize = ws.DefaultMaxMessageSize
+
+// WebsocketOptions configures the websocket Dialer
+type WebsocketOptions struct {
+	// TLSConfig is used for wss connections
+	TLSConfig *tls.Config
+	// Proxy returns the proxy to use, nil takes it from the environment
+	Proxy func(*http.Request) (*url.URL, error)
+	// Header is added to the websocket handshake
+	Header http.Header
+	// HandshakeTimeout for the websocket handshake, zero uses the default
+	HandshakeTimeout time.Duration
+	// MaxMessageSize is the maximum message size in bytes allowed from
+	// Home Assistant, zero uses DefaultMaxMessageSize
+	MaxMessageSize int64
+	// EnableCompression negotiates permessage-deflate with Home Assistant
+	EnableCompression bool
+}
+
+// WebsocketDialer returns a Dialer connecting to Home Assistant with a
+// websocket. Use it to wrap the default transport with your own, like
+// logging every message. The connection is kept alive with pings.
+func WebsocketDialer(options WebsocketOptions) Dialer {
+	return DialerFunc(func(ctx context.Context, url string) (Conn, error) {
+		conn, err := ws.Dial(ctx, url, ws.Options{
+			MaxMessageSize:    options.MaxMessageSize,
+			TLSConfig:         options.TLSConfig,
+			Proxy:             options.Proxy,
+			Header:            options.Header,
+			HandshakeTimeout:  options.HandshakeTimeout,
+			EnableCompression: options.EnableCompression})
+		if err != nil {
+			return nil, err
+		}
+		c := &websocketConn{conn: conn, reading: make(chan context.Context), closed: make(chan struct{})}
+		go c.watch()
+		return c, nil
+	})
+}
+
+// websocketConn is a Conn over a websocket
+type websocketConn struct {
+	conn *websocket.Conn
+	// Only one writer is allowed at a time
+	writeMutex sync.Mutex
+	// The context of the current read, nil when the read is done
+	reading chan context.Context
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// watch pings Home Assistant to keep the connection alive and unblocks a
+// read when its context is done
+func (a *websocketConn) watch() {
+	ticker := time.NewTicker(ws.PingPeriod)
+	defer ticker.Stop()
+	var done <-chan struct{}
+	for {
+		select {
+		case ctx := <-a.reading:
+			done = nil
+			if ctx != nil {
+				done = ctx.Done()
+			}
+		case <-done:
+			a.conn.SetReadDeadline(time.Now())
+			done = nil
+		case <-ticker.C:
+			a.writeMutex.Lock()
+			ws.Ping(a.conn)
+			a.writeMutex.Unlock()
+		case <-a.closed:
+			return
+		}
+	}
+}
+
+func (a *websocketConn) ReadMessage(ctx context.Context) ([]byte, error) {
+	// A cancelled read may have left the deadline in the past
+	ws.ExtendReadDeadline(a.conn)
+	select {
+	case a.reading <- ctx:
+	case <-a.closed:
+		return nil, ErrClosed
+	}
+	_, message, err := a.conn.ReadMessage()
+	select {
+	case a.reading <- nil:
+	case <-a.closed:
+	}
+	if err != nil {
+		return nil, a.err(ctx, err)
+	}
+	return message, nil
+}
+
+func (a *websocketConn) WriteMessage(ctx context.Context, message []byte) error {
+	a.writeMutex.Lock()
+	defer a.writeMutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	a.conn.SetWriteDeadline(deadline)
+	if err := a.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		return a.err(ctx, err)
+	}
+	return nil
+}
+
+func (a *websocketConn) Close() error {
+	var err error
+	a.once.Do(func() {
+		close(a.closed)
+		err = a.conn.Close()
+	})
+	return err
+}
+
+// err returns ErrClosed or the error of the context if that caused the
+// error
+func (a *websocketConn) err(ctx context.Context, err error) error {
+	select {
+	case <-a.closed:
+		return ErrClosed
+	default:
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}